@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/cluster-manager/cluster"
+	"github.com/rancher/cluster-manager/metrics"
+)
+
+var (
+	log = logrus.WithField("component", "api")
+)
+
+type Server struct {
+	manager *cluster.Manager
+}
+
+func New(manager *cluster.Manager) *Server {
+	return &Server{
+		manager: manager,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.status)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+func (s *Server) ListenAndServe(port int) error {
+	addr := fmt.Sprintf(":%d", port)
+	log.Infof("Serving cluster status and metrics on %s", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) status(rw http.ResponseWriter, req *http.Request) {
+	status, err := s.manager.Status()
+	if err != nil {
+		log.WithField("err", err).Error("Failed to get cluster status")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		log.WithField("err", err).Error("Failed to write cluster status")
+	}
+}
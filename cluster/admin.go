@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rancher/cluster-manager/config"
+	"github.com/rancher/cluster-manager/db"
+)
+
+func newAdmin(c *config.Config) *Manager {
+	hostname, _ := os.Hostname()
+	return &Manager{
+		Member: db.Member{
+			UUID: fmt.Sprintf("admin-%s-%d", hostname, os.Getpid()),
+		},
+		config: c,
+	}
+}
+
+func Evict(c *config.Config, uuid string, force bool) error {
+	m := newAdmin(c)
+	members, err := m.members()
+	if err != nil {
+		return err
+	}
+
+	member, ok := members[uuid]
+	if !ok {
+		return fmt.Errorf("Member %s not found", uuid)
+	}
+
+	if member.HeartbeatAge <= c.HeartbeatTimeout() && !force {
+		return fmt.Errorf("Member %s checked in %v ago and would rejoin, stop it first or force the eviction", uuid, member.HeartbeatAge)
+	}
+
+	if err := c.DB.ReleaseLease(uuid); err != nil {
+		return err
+	}
+
+	if err := c.DB.Delete(uuid); err != nil {
+		return err
+	}
+
+	m.recordEvent(db.EventEvict, uuid, "Evicted by administrator")
+	return nil
+}
+
+func StepDown(c *config.Config) (string, error) {
+	m := newAdmin(c)
+	lease, err := c.DB.StepDown(c.HeartbeatTimeout() + c.HeartbeatInterval)
+	if err != nil {
+		return "", err
+	}
+
+	if lease.Holder == "" {
+		return "", fmt.Errorf("No member currently holds the leader lease")
+	}
+
+	m.recordEvent(db.EventMaster, lease.Holder, "Stepped down from term %d by administrator", lease.Term)
+	return lease.Holder, nil
+}
+
+func Resize(c *config.Config, size int) error {
+	if size <= 0 || size%2 == 0 {
+		return fmt.Errorf("Cluster size must be a positive odd number, got %d", size)
+	}
+
+	m := newAdmin(c)
+	if err := c.DB.SetDesiredSize(size); err != nil {
+		return err
+	}
+
+	m.recordEvent(db.EventResize, "", "Desired cluster size set to %d by administrator", size)
+	return nil
+}
+
+func Reindex(c *config.Config) error {
+	m := newAdmin(c)
+	if size, err := c.DB.DesiredSize(); err != nil {
+		return err
+	} else if size > 0 {
+		c.ClusterSize = size
+		m.desiredSize = size
+	}
+
+	master, term, err := m.elect()
+	if err != nil {
+		return err
+	}
+
+	if !master {
+		return fmt.Errorf("Member %s holds the leader lease, stop all cluster managers before reindexing", m.lease.Holder)
+	}
+	defer c.DB.ReleaseLease(m.UUID)
+
+	// Every manager is stopped, so nobody is checking in. Keep their rows and only move the indexes.
+	members, err := m.members()
+	if err != nil {
+		return err
+	}
+
+	assigned := []db.Member{}
+	for _, member := range members {
+		if member.Index > 0 {
+			assigned = append(assigned, member)
+		}
+	}
+
+	if err := c.DB.SaveIndex(term, assigned, nil); err != nil {
+		return err
+	}
+	for _, member := range assigned {
+		m.recordEvent(db.EventReleaseIndex, member.UUID, "Index %d released for reindex", member.Index)
+	}
+
+	members, err = m.members()
+	if err != nil {
+		return err
+	}
+
+	// Nobody checks in while every manager is stopped, so treat them all as healthy spares and size by the desired size
+	for uuid, member := range members {
+		member.HeartbeatAge = 0
+		member.Leaving = false
+		member.ClusterSize = 0
+		members[uuid] = member
+	}
+
+	_, err = m.assignIndex(term, members)
+	return err
+}
+
+func Drain(c *config.Config, uuid string, draining bool) error {
+	m := newAdmin(c)
+	if err := c.DB.SetDraining(uuid, draining); err != nil {
+		return err
+	}
+
+	if draining {
+		m.recordEvent(db.EventDrain, uuid, "Drained by administrator")
+	} else {
+		m.recordEvent(db.EventUndrain, uuid, "Released from draining by administrator")
+	}
+	return nil
+}
@@ -1,26 +1,73 @@
 package cluster
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/cluster-manager/config"
 	"github.com/rancher/cluster-manager/db"
 	"github.com/rancher/cluster-manager/docker"
+	"github.com/rancher/cluster-manager/metrics"
 	"github.com/rancher/cluster-manager/service"
 )
 
 var (
-	interval  = 5 * time.Second
-	log       = logrus.WithField("component", "manager")
-	maxMissed = 2
+	log = logrus.WithField("component", "manager")
 )
 
+// clusterServices runs zookeeper, redis and cattle, see service.ClusterService
+type clusterServices interface {
+	RequestedIndex() (int, error)
+	Update(master bool, term int64, byIndex map[int]db.Member) error
+	Size() int
+	Reconfigure()
+	Drain(draining bool) error
+	Status() (service.Status, error)
+}
+
 type Manager struct {
 	db.Member
-	config   *config.Config
-	services *service.ClusterService
+	sync.Mutex
+	config      *config.Config
+	docker      *docker.Docker
+	services    clusterServices
+	desiredSize int
+	lease       db.Lease
+	degraded    bool
+	recovered   time.Time
+	keysRetired bool
+	reloads     chan struct{}
+}
+
+type MemberStatus struct {
+	UUID           string         `json:"uuid"`
+	Name           string         `json:"name"`
+	IP             string         `json:"ip"`
+	Ports          map[string]int `json:"ports"`
+	RequestedIndex int            `json:"requestedIndex"`
+	Index          int            `json:"assignedIndex"`
+	HeartbeatAge   float64        `json:"heartbeatAgeSeconds"`
+	Master         bool           `json:"master"`
+	Draining       bool           `json:"draining"`
+	Leaving        bool           `json:"leaving"`
+	KeyID          string         `json:"keyId"`
+}
+
+type Status struct {
+	ClusterID   string         `json:"clusterId"`
+	UUID        string         `json:"uuid"`
+	Master      string         `json:"master"`
+	Term        int64          `json:"term"`
+	ClusterSize int            `json:"clusterSize"`
+	Degraded    bool           `json:"degraded"`
+	DBEndpoint  string         `json:"dbEndpoint"`
+	Members     []MemberStatus `json:"members"`
+	service.Status
 }
 
 func New(config *config.Config) (*Manager, error) {
@@ -47,15 +94,18 @@ func New(config *config.Config) (*Manager, error) {
 			IP:             config.ClusterIP,
 			RequestedIndex: requestedIndex,
 			Ports:          config.Ports,
+			KeyID:          config.KeyID,
 		},
 		config:   config,
+		docker:   d,
 		services: services,
+		reloads:  make(chan struct{}, 1),
 	}
 
 	return m, nil
 }
 
-func (m *Manager) Start() error {
+func (m *Manager) Start(ctx context.Context) error {
 	id, err := m.services.RequestedIndex()
 	if err != nil {
 		return err
@@ -63,94 +113,441 @@ func (m *Manager) Start() error {
 
 	m.RequestedIndex = id
 
-	m.checkin(0)
-	go m.heartbeat()
-	return m.loop()
+	if err := m.seedDesiredSize(); err != nil {
+		return err
+	}
+	metrics.DBAvailable.SetBool(true)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := m.checkin(0); err != nil {
+		log.WithField("err", err).Error("Failed to do cluster check in")
+	}
+	heartbeatDone := make(chan struct{})
+	go func() {
+		m.heartbeat(ctx)
+		close(heartbeatDone)
+	}()
+	go m.watchConfig(ctx)
+
+	err = m.loop(ctx)
+	shutdown := ctx.Err() != nil
+	cancel()
+	<-heartbeatDone
+
+	if shutdown {
+		return m.leave()
+	}
+	return err
 }
 
-func (m *Manager) checkin(i int) {
-	if err := m.config.DB.Checkin(m.Member, i); err != nil {
-		log.WithField("err", err).Fatal("Failed to do cluster check in")
+func (m *Manager) seedDesiredSize() error {
+	size, err := m.config.DB.DesiredSize()
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		log.Infof("Setting desired cluster size to %d", m.config.ClusterSize)
+		return m.config.DB.SetDesiredSize(m.config.ClusterSize)
 	}
+
+	if size != m.config.ClusterSize {
+		// Nothing runs yet with the configured size, so starting at the desired one is safe
+		log.Infof("Using desired cluster size %d from database instead of %d", size, m.config.ClusterSize)
+		m.applySize(size)
+	}
+
+	return nil
 }
 
-type seen struct {
-	member    db.Member
-	heartbeat int
-	missed    int
+func (m *Manager) leave() error {
+	log.WithField("uuid", m.UUID).Info("Leaving cluster")
+	if err := m.config.DB.ReleaseLease(m.UUID); err != nil {
+		log.WithField("err", err).Error("Failed to release leader lease")
+	}
+
+	// Keep the row so a restarted manager is recognised, the master prunes it after the grace period
+	if err := m.config.DB.Leave(m.UUID); err != nil {
+		return err
+	}
+	m.recordEvent(db.EventLeave, m.UUID, "Shutting down")
+
+	if m.config.StopOnLeave {
+		return m.docker.StopAll()
+	}
+
+	return nil
 }
 
-func (m *Manager) updateMembers(members map[string]*seen) error {
-	for _, h := range members {
-		h.missed++
+func (m *Manager) checkin(i int) error {
+	m.Lock()
+	member := m.Member
+	m.Unlock()
+	return m.config.DB.Checkin(member, i)
+}
+
+func (m *Manager) members() (map[string]db.Member, error) {
+	result := map[string]db.Member{}
+
+	members, err := m.config.DB.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		result[member.UUID] = member
+	}
+
+	return result, nil
+}
+
+func (m *Manager) pruneMembers(term int64, members map[string]db.Member) error {
+	timeout := m.config.HeartbeatTimeout()
+	m.Lock()
+	recovered := m.recovered
+	m.Unlock()
+
+	// Nobody could check in while the database was unavailable, give everyone a chance before pruning
+	if time.Since(recovered) < timeout {
+		return nil
+	}
+
+	for key, member := range members {
+		if member.HeartbeatAge > timeout && (!member.Leaving || member.HeartbeatAge > timeout+m.config.LeaveGrace) {
+			log.WithFields(logrus.Fields{"member": member, "age": member.HeartbeatAge}).Info("Forgetting cluster member")
+			err := m.config.DB.Evict(term, key)
+			if err == db.ErrStaleTerm {
+				return err
+			} else if err != nil {
+				log.WithFields(logrus.Fields{"err": err, "member": member}).Errorf("Failed to delete member")
+			} else {
+				m.recordEvent(db.EventEvict, key, "No heartbeat for %v", member.HeartbeatAge)
+				delete(members, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) Status() (Status, error) {
+	m.Lock()
+	lease := m.lease
+	degraded := m.degraded
+	size := m.config.ClusterSize
+	m.Unlock()
+
+	status := Status{
+		Degraded:    degraded,
+		DBEndpoint:  m.config.DB.Endpoint(),
+		ClusterID:   m.config.ClusterID,
+		UUID:        m.UUID,
+		Master:      lease.Holder,
+		Term:        lease.Term,
+		ClusterSize: size,
+		Members:     []MemberStatus{},
 	}
 
-	newMembers, err := m.config.DB.Members()
+	members, err := m.config.DB.Members()
+	if err != nil {
+		return status, err
+	}
+
+	for _, member := range members {
+		status.Members = append(status.Members, MemberStatus{
+			UUID:           member.UUID,
+			Name:           member.Name,
+			IP:             member.IP,
+			Ports:          member.Ports,
+			RequestedIndex: member.RequestedIndex,
+			Index:          member.Index,
+			HeartbeatAge:   member.HeartbeatAge.Seconds(),
+			Master:         member.UUID == lease.Holder,
+			Draining:       member.Draining,
+			Leaving:        member.Leaving,
+			KeyID:          member.KeyID,
+		})
+	}
+
+	status.Status, err = m.services.Status()
+	return status, err
+}
+
+func (m *Manager) recordEvent(event, target, reason string, args ...interface{}) {
+	err := m.config.DB.RecordEvent(db.Event{
+		Actor:  m.UUID,
+		Event:  event,
+		Target: target,
+		Reason: fmt.Sprintf(reason, args...),
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err, "event": event, "target": target}).Error("Failed to record cluster event")
+	}
+}
+
+func (m *Manager) elect() (bool, int64, error) {
+	ttl := m.config.HeartbeatTimeout() + m.config.HeartbeatInterval
+	lease, err := m.config.DB.AcquireLease(m.UUID, ttl)
+	if err != nil {
+		return false, 0, err
+	}
+
+	m.Lock()
+	m.lease = lease
+	m.Unlock()
+
+	return lease.Holder == m.UUID, lease.Term, nil
+}
+
+// resize moves this member to the desired size once the master gives it its turn
+func (m *Manager) resize(master bool, members map[string]db.Member) error {
+	desired, err := m.config.DB.DesiredSize()
 	if err != nil {
 		return err
 	}
 
-	for _, member := range newMembers {
-		seenMember := members[member.UUID]
-		if seenMember == nil {
-			members[member.UUID] = &seen{
-				member:    member,
-				heartbeat: member.Heartbeat,
-			}
-		} else {
-			seenMember.member = member
-			if seenMember.heartbeat != member.Heartbeat {
-				seenMember.missed = 0
-				seenMember.heartbeat = member.Heartbeat
-			}
+	if desired == 0 {
+		return nil
+	}
+
+	if desired < 0 || desired%2 == 0 {
+		log.Errorf("Ignoring desired cluster size %d, it must be a positive odd number", desired)
+		return nil
+	}
+
+	m.desiredSize = desired
+	if master {
+		if err := m.stageResize(desired, members); err != nil {
+			return err
 		}
 	}
 
+	if desired == m.config.ClusterSize {
+		return nil
+	}
+
+	step, err := m.config.DB.ResizeStep()
+	if err != nil || step != m.UUID {
+		return err
+	}
+
+	log.Infof("Resizing cluster from %d to %d", m.config.ClusterSize, desired)
+	m.applySize(desired)
 	return nil
 }
 
-func (m *Manager) pruneMembers(members map[string]*seen) error {
-	for key, seen := range members {
-		if seen.missed >= maxMissed {
-			log.WithField("member", seen.member).Info("Forgetting cluster member")
-			err := m.config.DB.Delete(key)
-			if err != nil {
-				log.WithFields(logrus.Fields{"err": err, "member": seen.member}).Errorf("Failed to delete member")
-			} else {
-				delete(members, key)
+// stageResize lets one live member at a time switch to the desired size, so zookeeper and redis
+// are never recreated on every member at once
+func (m *Manager) stageResize(desired int, members map[string]db.Member) error {
+	step, err := m.config.DB.ResizeStep()
+	if err != nil {
+		return err
+	}
+	if member, ok := members[step]; ok && pendingSize(member, desired, m.config.HeartbeatTimeout()) {
+		// Still waiting for the current member to report the new size
+		return nil
+	}
+
+	pending := []db.Member{}
+	growing := false
+	for _, member := range members {
+		if !pendingSize(member, desired, m.config.HeartbeatTimeout()) {
+			continue
+		}
+		pending = append(pending, member)
+		growing = growing || member.ClusterSize < desired
+	}
+
+	if len(pending) == 0 {
+		if step != "" {
+			log.Infof("Every member runs with cluster size %d", desired)
+			return m.config.DB.SetResizeStep("")
+		}
+		return nil
+	}
+
+	// Only grow once every new index has a member, the current quorum stays untouched until then
+	if growing {
+		byIndex := sortByIndex(members)
+		for i := 1; i <= desired; i++ {
+			if _, ok := byIndex[i]; !ok {
+				log.Infof("Waiting for index %d to be assigned before growing cluster to %d", i, desired)
+				return nil
 			}
 		}
 	}
 
+	// Quorum members first in index order, spares last
+	sort.Slice(pending, func(i, j int) bool {
+		if (pending[i].Index == 0) != (pending[j].Index == 0) {
+			return pending[j].Index == 0
+		}
+		if pending[i].Index != pending[j].Index {
+			return pending[i].Index < pending[j].Index
+		}
+		return pending[i].ID < pending[j].ID
+	})
+
+	next := pending[0]
+	log.Infof("Letting %s %s switch to cluster size %d", next.UUID, next.IP, desired)
+	return m.config.DB.SetResizeStep(next.UUID)
+}
+
+// pendingSize reports whether a live member still runs with another size. Members that have
+// not reported a size yet, such as older versions, are not waited for.
+func pendingSize(member db.Member, desired int, timeout time.Duration) bool {
+	return member.ClusterSize != 0 && member.ClusterSize != desired && member.HeartbeatAge <= timeout
+}
+
+// applySize makes the next Update rebuild zookeeper and redis with size. The member only reports it once
+// that succeeded, see updateServices.
+func (m *Manager) applySize(size int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.config.ClusterSize = size
+}
+
+// updateServices brings the services in line with the members and reports the size they now run with
+func (m *Manager) updateServices(master bool, term int64, members map[string]db.Member) error {
+	if err := m.services.Update(master, term, sortByIndex(members)); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.ClusterSize = m.services.Size()
 	return nil
 }
 
-func (m *Manager) isMaster(members map[string]*seen) bool {
-	master := members[m.UUID]
-	if master == nil {
-		return false
+// indexCount keeps the larger size's indexes until every live member has switched to the smaller one
+func (m *Manager) indexCount(members map[string]db.Member) int {
+	count := m.config.ClusterSize
+	if m.desiredSize > count {
+		count = m.desiredSize
 	}
+	for _, member := range members {
+		if member.ClusterSize > count && member.HeartbeatAge <= m.config.HeartbeatTimeout() {
+			count = member.ClusterSize
+		}
+	}
+	return count
+}
 
+func (m *Manager) moveDrainingIndexes(term int64, members map[string]db.Member) (bool, error) {
 	for _, member := range members {
-		if member.member.ID < master.member.ID {
-			master = member
+		if !member.Draining || member.Index <= 0 {
+			continue
 		}
+
+		spare, ok := findSpare(members, m.config.HeartbeatTimeout())
+		if !ok {
+			log.Infof("Holding index %d for draining member %s %s until a spare is available", member.Index, member.UUID, member.IP)
+			continue
+		}
+
+		log.Infof("Moving index %d from draining member %s %s to %s %s", member.Index, member.UUID, member.IP, spare.UUID, spare.IP)
+		if err := m.config.DB.SaveIndex(term, []db.Member{member}, map[int]db.Member{member.Index: spare}); err != nil {
+			return false, err
+		}
+
+		m.recordEvent(db.EventReleaseIndex, member.UUID, "Member is draining, index %d released", member.Index)
+		m.recordEvent(db.EventAssignIndex, spare.UUID, "Replacing draining member %s, assigned index %d", member.UUID, member.Index)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// releaseLeavingIndexes hands the index of a member that shut down to a spare right away instead of waiting for
+// its heartbeat to time out. Its row and requested index stay, so it can reclaim the index if it is still free.
+func (m *Manager) releaseLeavingIndexes(term int64, members map[string]db.Member) (bool, error) {
+	for _, member := range members {
+		if !member.Leaving || member.Index <= 0 {
+			continue
+		}
+
+		assign := map[int]db.Member{}
+		if spare, ok := findSpare(members, m.config.HeartbeatTimeout()); ok {
+			log.Infof("Moving index %d from leaving member %s %s to %s %s", member.Index, member.UUID, member.IP, spare.UUID, spare.IP)
+			assign[member.Index] = spare
+		} else {
+			log.Infof("Releasing index %d from leaving member %s %s", member.Index, member.UUID, member.IP)
+		}
+		if err := m.config.DB.SaveIndex(term, []db.Member{member}, assign); err != nil {
+			return false, err
+		}
+
+		m.recordEvent(db.EventReleaseIndex, member.UUID, "Member left, index %d released", member.Index)
+		for index, spare := range assign {
+			m.recordEvent(db.EventAssignIndex, spare.UUID, "Replacing leaving member %s, assigned index %d", member.UUID, index)
+		}
+		return true, nil
 	}
 
-	return master.member.UUID == m.UUID
+	return false, nil
+}
+
+// healthy is false for members that are shutting down or have stopped checking in, they must not take an index
+func healthy(member db.Member, timeout time.Duration) bool {
+	return !member.Leaving && member.HeartbeatAge <= timeout
 }
 
-func (m *Manager) assignIndex(oldMembers map[string]*seen) (bool, error) {
+func findSpare(members map[string]db.Member, timeout time.Duration) (db.Member, bool) {
+	spare := db.Member{}
+	found := false
+	for _, member := range members {
+		if member.Index > 0 || member.Draining || !healthy(member, timeout) {
+			continue
+		}
+		if !found || member.ID < spare.ID {
+			spare = member
+			found = true
+		}
+	}
+	return spare, found
+}
+
+func (m *Manager) assignIndex(term int64, oldMembers map[string]db.Member) (bool, error) {
 	changed := false
 	sortedKeys := []int{}
 	byIndex := map[int]db.Member{}
 	members := map[int]db.Member{}
+	reasons := map[int]string{}
+	size := m.indexCount(oldMembers)
+
+	released := []db.Member{}
+	for _, member := range oldMembers {
+		if member.Index > size {
+			log.Infof("Releasing index %d from %s %s", member.Index, member.UUID, member.IP)
+			released = append(released, member)
+		}
+	}
+
+	if len(released) > 0 {
+		if err := m.config.DB.SaveIndex(term, released, nil); err != nil {
+			return false, err
+		}
+		for _, member := range released {
+			m.recordEvent(db.EventReleaseIndex, member.UUID, "Index %d is beyond cluster size %d", member.Index, size)
+		}
+		return true, nil
+	}
+
+	if changed, err := m.moveDrainingIndexes(term, oldMembers); err != nil || changed {
+		return changed, err
+	}
 
-	for _, v := range oldMembers {
-		member := v.member
+	if changed, err := m.releaseLeavingIndexes(term, oldMembers); err != nil || changed {
+		return changed, err
+	}
+
+	for _, member := range oldMembers {
 		if member.Index > 0 {
 			byIndex[member.Index] = member
-		} else {
+		} else if !member.Draining && healthy(member, m.config.HeartbeatTimeout()) {
 			sortedKeys = append(sortedKeys, member.ID)
 			members[member.ID] = member
 		}
@@ -164,12 +561,13 @@ func (m *Manager) assignIndex(oldMembers map[string]*seen) (bool, error) {
 			continue
 		}
 
-		if member.RequestedIndex <= 0 {
+		if member.RequestedIndex <= 0 || member.RequestedIndex > size {
 			continue
 		}
 
 		if _, ok := byIndex[member.RequestedIndex]; !ok {
 			log.Infof("Assigning %s %s to index %d by request", member.UUID, member.IP, member.RequestedIndex)
+			reasons[member.RequestedIndex] = "Requested"
 			changed = true
 			byIndex[member.RequestedIndex] = member
 			delete(members, key)
@@ -177,13 +575,14 @@ func (m *Manager) assignIndex(oldMembers map[string]*seen) (bool, error) {
 	}
 
 	// Assign my missing index
-	for i := 1; i <= m.config.ClusterSize; i++ {
+	for i := 1; i <= size; i++ {
 		if _, ok := byIndex[i]; ok {
 			continue
 		}
 
 		for _, member := range members {
 			log.Infof("Assigning %s %s to index %d", member.UUID, member.IP, i)
+			reasons[i] = "Index was unassigned"
 			changed = true
 			byIndex[i] = member
 			delete(members, member.ID)
@@ -192,61 +591,274 @@ func (m *Manager) assignIndex(oldMembers map[string]*seen) (bool, error) {
 	}
 
 	if changed {
-		if err := m.config.DB.SaveIndex(byIndex); err != nil {
+		if err := m.config.DB.SaveIndex(term, nil, byIndex); err != nil {
 			return false, err
 		}
+		for index, reason := range reasons {
+			m.recordEvent(db.EventAssignIndex, byIndex[index].UUID, "%s, assigned index %d", reason, index)
+		}
 	}
 
 	return changed, nil
 }
 
-func (m *Manager) loop() error {
-	members := map[string]*seen{}
+func (m *Manager) loop(ctx context.Context) error {
 	master := false
-	for ; ; time.Sleep(interval) {
-		if err := m.updateMembers(members); err != nil {
-			return err
+	wait := m.config.HeartbeatInterval
+	backoff := db.Backoff{Initial: m.config.HeartbeatInterval, Max: m.config.DBRetryMaxInterval}
+	launched := m.config.DB.Endpoint()
+	for ; ; sleep(ctx, wait) {
+		if ctx.Err() != nil {
+			return nil
 		}
 
-		if err := m.pruneMembers(members); err != nil {
-			return err
+		select {
+		case <-m.reloads:
+			m.reload()
+		default:
 		}
 
-		newValue := m.isMaster(members)
-		if newValue != master {
-			log.WithField("master", newValue).Infof("Currently Master: %t", newValue)
+		if m.Degraded() {
+			if err := m.config.DB.Ping(); err != nil {
+				wait = backoff.Next()
+				log.WithField("err", err).Warnf("Database still unavailable, retrying in %v", wait)
+				continue
+			}
+			log.Info("Database available again")
+			m.setDegraded(false)
+			backoff.Reset()
 		}
-		master = newValue
 
-		if master {
-			if changed, err := m.assignIndex(members); err != nil {
+		wait = m.config.HeartbeatInterval
+		endpoint := m.config.DB.Endpoint()
+		if endpoint != launched {
+			// Cattle still points at the old endpoint, relaunch it with the settings for the new one
+			log.Infof("Database endpoint changed from %s to %s, relaunching services", launched, endpoint)
+			m.services.Reconfigure()
+			launched = endpoint
+		}
+		metrics.LoopIterations.Inc()
+		newValue, err := m.reconcile(master)
+		if err != nil {
+			metrics.LoopErrors.Inc()
+			// Ping fails over to another endpoint when it can, which also counts as an outage
+			if m.config.DB.Ping() == nil && m.config.DB.Endpoint() == endpoint {
 				return err
-			} else if changed {
-				continue
 			}
+
+			// Running zk, redis and cattle containers are left alone until the database is back
+			wait = backoff.Next()
+			log.WithField("err", err).Warnf("Database unavailable, leaving running services alone and retrying in %v", wait)
+			m.setDegraded(true)
+			continue
 		}
+		master = newValue
+	}
+}
 
-		byIndex := sortByIndex(members)
+// Reload asks the reconcile loop to load the configuration again before its next iteration
+func (m *Manager) Reload() {
+	select {
+	case m.reloads <- struct{}{}:
+	default:
+	}
+}
 
-		if err := m.services.Update(master, byIndex); err != nil {
-			return err
+func (m *Manager) reload() {
+	next, changes, err := m.config.Reload()
+	if err != nil {
+		log.WithField("err", err).Error("Rejected configuration reload")
+		return
+	}
+	if len(changes) == 0 {
+		log.Info("Configuration reloaded, nothing changed")
+		return
+	}
+
+	for _, change := range changes {
+		log.WithFields(logrus.Fields{"old": change.Old, "new": change.New}).Infof("Configuration %s changed", change.Field)
+	}
+	if err := m.config.Apply(next, changes); err != nil {
+		log.WithField("err", err).Error("Rejected configuration reload")
+		return
+	}
+
+	m.Lock()
+	m.Ports = m.config.Ports
+	m.KeyID = m.config.KeyID
+	m.Unlock()
+	m.keysRetired = false
+
+	m.docker.Configure(m.config.Image, m.config.Ports, m.config.ContainerEnv)
+	m.services.Reconfigure()
+	log.Info("Configuration reloaded, reconciling containers")
+}
+
+// watchConfig reloads when the config file is created, changed or removed
+func (m *Manager) watchConfig(ctx context.Context) {
+	modified := func() time.Time {
+		if info, err := os.Stat(m.config.ConfigFilePath()); err == nil {
+			return info.ModTime()
+		}
+		return time.Time{}
+	}
+
+	last := modified()
+	for sleep(ctx, m.config.HeartbeatInterval) {
+		if current := modified(); !current.Equal(last) {
+			log.Infof("%s changed, reloading configuration", m.config.ConfigFilePath())
+			last = current
+			m.Reload()
+		}
+	}
+}
+
+func (m *Manager) Degraded() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.degraded
+}
+
+func (m *Manager) setDegraded(degraded bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.degraded && !degraded {
+		m.recovered = time.Now()
+	}
+	m.degraded = degraded
+	metrics.DBAvailable.SetBool(!degraded)
+}
+
+func (m *Manager) reconcile(master bool) (bool, error) {
+	members, err := m.members()
+	if err != nil {
+		return master, err
+	}
+	m.updateMemberMetrics(members)
+	m.retireKeys(members)
+
+	var (
+		draining = members[m.UUID].Draining
+		newValue bool
+		term     int64
+	)
+	if draining {
+		err = m.config.DB.ReleaseLease(m.UUID)
+	} else {
+		newValue, term, err = m.elect()
+	}
+	if err != nil {
+		return master, err
+	}
+	if newValue != master {
+		log.WithFields(logrus.Fields{"master": newValue, "term": term}).Infof("Currently Master: %t", newValue)
+		if newValue {
+			m.recordEvent(db.EventMaster, m.UUID, "Acquired leader lease at term %d", term)
+		}
+	}
+	master = newValue
+	metrics.Master.SetBool(master)
+
+	if master {
+		if err := m.pruneMembers(term, members); err == db.ErrStaleTerm {
+			log.WithField("term", term).Info("Lost leader lease while pruning members")
+			return master, nil
+		} else if err != nil {
+			return master, err
+		}
+	}
+
+	if err := m.resize(master, members); err != nil {
+		return master, err
+	}
+
+	if master {
+		if changed, err := m.assignIndex(term, members); err == db.ErrStaleTerm {
+			log.WithField("term", term).Info("Lost leader lease while assigning indexes")
+			return master, nil
+		} else if err == db.ErrIndexConflict {
+			log.WithField("term", term).Warn("Index assignment conflicted with a concurrent change, retrying")
+			metrics.IndexConflicts.Inc()
+			return master, nil
+		} else if err != nil {
+			return master, err
+		} else if changed {
+			return master, nil
+		}
+	}
+
+	if err := m.services.Drain(draining); err != nil {
+		return master, err
+	}
+
+	return master, m.updateServices(master, term, members)
+}
+
+// retireKeys retires the encryption keys replaced by this member's active key once every member reports it
+func (m *Manager) retireKeys(members map[string]db.Member) {
+	if m.keysRetired || m.config.KeyID == "" {
+		return
+	}
+	for _, member := range members {
+		if member.KeyID != m.config.KeyID {
+			return
+		}
+	}
+
+	retired, err := m.config.RetireKeys()
+	if err != nil {
+		log.WithField("err", err).Error("Failed to retire encryption keys")
+		return
+	}
+	for _, id := range retired {
+		log.WithField("key", id).Info("Retired encryption key, every member reports the new key")
+	}
+	m.keysRetired = true
+}
+
+func (m *Manager) updateMemberMetrics(members map[string]db.Member) {
+	timeout := m.config.HeartbeatTimeout()
+	live := 0
+
+	metrics.HeartbeatAge.Reset()
+	for _, member := range members {
+		if member.HeartbeatAge <= timeout {
+			live++
 		}
+		metrics.HeartbeatAge.Set(member.HeartbeatAge.Seconds(), member.UUID, member.Name, member.IP)
 	}
+
+	metrics.MembersLive.Set(float64(live))
+	metrics.ClusterSize.Set(float64(m.config.ClusterSize))
 }
 
-func sortByIndex(members map[string]*seen) map[int]db.Member {
+func sortByIndex(members map[string]db.Member) map[int]db.Member {
 	result := map[int]db.Member{}
 	for _, member := range members {
-		if member.member.Index > 0 {
-			result[member.member.Index] = member.member
+		if member.Index > 0 {
+			result[member.Index] = member
 		}
 	}
 	return result
 }
 
-func (m *Manager) heartbeat() {
+func (m *Manager) heartbeat(ctx context.Context) {
 	for i := 1; ; i++ {
-		m.checkin(i)
-		time.Sleep(interval)
+		if !sleep(ctx, m.config.HeartbeatInterval) {
+			return
+		}
+		if err := m.checkin(i); err != nil {
+			log.WithField("err", err).Error("Failed to do cluster check in")
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
 }
@@ -0,0 +1,691 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rancher/cluster-manager/config"
+	"github.com/rancher/cluster-manager/db"
+	"github.com/rancher/cluster-manager/service"
+)
+
+func newTestManager(uuid string, store db.MembershipStore) *Manager {
+	c := &config.Config{
+		UUID:              uuid,
+		ClusterSize:       3,
+		DB:                store,
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatMissed:   2,
+	}
+	return &Manager{
+		Member: db.Member{
+			UUID: uuid,
+		},
+		config:   c,
+		services: &fakeServices{config: c},
+	}
+}
+
+// fakeServices configures instantly unless fail is set, like zookeeper never becoming ready
+type fakeServices struct {
+	config *config.Config
+	size   int
+	fail   bool
+}
+
+func (f *fakeServices) RequestedIndex() (int, error) { return 0, nil }
+func (f *fakeServices) Size() int                    { return f.size }
+func (f *fakeServices) Reconfigure()                 {}
+func (f *fakeServices) Drain(draining bool) error    { return nil }
+func (f *fakeServices) Status() (service.Status, error) {
+	return service.Status{}, nil
+}
+
+func (f *fakeServices) Update(master bool, term int64, byIndex map[int]db.Member) error {
+	if f.fail {
+		return errors.New("Zookeeper is not ready")
+	}
+	f.size = f.config.ClusterSize
+	return nil
+}
+
+func checkin(t *testing.T, store db.MembershipStore, uuid string, requested, heartbeat int) {
+	if err := store.Checkin(db.Member{UUID: uuid, IP: uuid, RequestedIndex: requested}, heartbeat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssignIndex(t *testing.T) {
+	store := db.NewMemoryStore()
+	checkin(t, store, "a", 0, 0)
+	checkin(t, store, "b", 1, 0)
+	checkin(t, store, "c", 0, 0)
+	checkin(t, store, "d", 0, 0)
+
+	m := newTestManager("a", store)
+	members, err := m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master, term, err := m.elect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !master {
+		t.Fatal("Expected a to be master")
+	}
+
+	changed, err := m.assignIndex(term, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("Expected index assignment to change")
+	}
+
+	members, err = m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byIndex := sortByIndex(members)
+	if len(byIndex) != 3 {
+		t.Fatalf("Expected 3 assigned indexes, got %d", len(byIndex))
+	}
+	if byIndex[1].UUID != "b" {
+		t.Fatalf("Expected b to get its requested index 1, got %s", byIndex[1].UUID)
+	}
+
+	changed, err = m.assignIndex(term, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("Expected no change on second assignment")
+	}
+}
+
+func TestAssignIndexStaleTerm(t *testing.T) {
+	store := db.NewMemoryStore()
+	checkin(t, store, "a", 0, 0)
+
+	m := newTestManager("a", store)
+	members, err := m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, term, err := m.elect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.assignIndex(term-1, members); err != db.ErrStaleTerm {
+		t.Fatalf("Expected stale term error, got %v", err)
+	}
+}
+
+func TestElect(t *testing.T) {
+	store := db.NewMemoryStore()
+	a := newTestManager("a", store)
+	b := newTestManager("b", store)
+
+	if master, _, err := a.elect(); err != nil || !master {
+		t.Fatalf("Expected a to become master: %v", err)
+	}
+	if master, _, err := b.elect(); err != nil || master {
+		t.Fatalf("Expected b to not become master while a holds the lease: %v", err)
+	}
+	if master, _, err := a.elect(); err != nil || !master {
+		t.Fatalf("Expected a to renew its lease: %v", err)
+	}
+}
+
+func TestPruneMembers(t *testing.T) {
+	store := db.NewMemoryStore()
+	checkin(t, store, "a", 0, 0)
+	checkin(t, store, "b", 0, 0)
+
+	b := newTestManager("b", store)
+	time.Sleep(b.config.HeartbeatTimeout() + b.config.HeartbeatInterval)
+	checkin(t, store, "b", 0, 1)
+
+	_, term, err := b.elect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := b.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pruneMembers(term+1, members); err != db.ErrStaleTerm {
+		t.Fatalf("Expected pruning with a stale term to fail, got %v", err)
+	}
+	if err := b.pruneMembers(term, members); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := members["a"]; ok {
+		t.Fatal("Expected a to be pruned")
+	}
+	if _, ok := members["b"]; !ok {
+		t.Fatal("Expected b to be kept")
+	}
+
+	remaining, err := store.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].UUID != "b" {
+		t.Fatalf("Expected only b to remain, got %#v", remaining)
+	}
+
+	events, err := store.Events(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != db.EventEvict || events[0].Actor != "b" || events[0].Target != "a" {
+		t.Fatalf("Expected eviction of a by b to be recorded, got %#v", events)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	store := db.NewMemoryStore()
+	checkin(t, store, "a", 0, 0)
+	checkin(t, store, "b", 0, 0)
+
+	a := newTestManager("a", store)
+	b := newTestManager("b", store)
+	a.config.ClusterSize, b.config.ClusterSize = 1, 1
+
+	master, term, err := a.elect()
+	if err != nil || !master {
+		t.Fatalf("Expected a to become master: %v", err)
+	}
+	members, err := a.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.assignIndex(term, members); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.leave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if members, err = b.members(); err != nil {
+		t.Fatal(err)
+	}
+	if !members["a"].Leaving {
+		t.Fatal("Expected a to be kept and marked as leaving")
+	}
+
+	master, term, err = b.elect()
+	if err != nil || !master || term != 2 {
+		t.Fatalf("Expected b to take over the released lease at term 2, got %t %d: %v", master, term, err)
+	}
+
+	// The index moves to a spare on the next pass, without waiting for a's heartbeat to time out
+	if _, err := b.assignIndex(term, members); err != nil {
+		t.Fatal(err)
+	}
+	if members, err = b.members(); err != nil {
+		t.Fatal(err)
+	}
+	if members["a"].Index != 0 || members["b"].Index != 1 {
+		t.Fatalf("Expected index 1 to move from leaving a to b, got %+v", members)
+	}
+
+	// Within the grace period a is kept, and checking in again clears the flag
+	b.config.LeaveGrace = time.Hour
+	time.Sleep(b.config.HeartbeatTimeout() * 2)
+	if _, term, err = b.elect(); err != nil {
+		t.Fatal(err)
+	}
+	if members, err = b.members(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pruneMembers(term, members); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["a"]; !ok {
+		t.Fatal("Expected a to be kept within the grace period")
+	}
+	checkin(t, store, "a", 0, 0)
+	if members, err = b.members(); err != nil {
+		t.Fatal(err)
+	}
+	if member, ok := members["a"]; !ok || member.Leaving {
+		t.Fatalf("Expected a to rejoin with its row, got %+v", member)
+	}
+
+	if err := a.leave(); err != nil {
+		t.Fatal(err)
+	}
+	b.config.LeaveGrace = 0
+	time.Sleep(b.config.HeartbeatTimeout() * 2)
+	if _, term, err = b.elect(); err != nil {
+		t.Fatal(err)
+	}
+	if members, err = b.members(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pruneMembers(term, members); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := members["a"]; ok {
+		t.Fatal("Expected a to be forgotten after the grace period")
+	}
+}
+
+// resizeCluster runs one manager per uuid against store, the first one is master. step runs a loop iteration
+// on every manager and returns the assigned indexes, sizes counts the managers configured with each size.
+func resizeCluster(t *testing.T, store db.MembershipStore, uuids ...string) (managers []*Manager, step func() map[int]db.Member, sizes func() map[int]int) {
+	for _, uuid := range uuids {
+		managers = append(managers, newTestManager(uuid, store))
+	}
+
+	master := managers[0]
+	if err := master.seedDesiredSize(); err != nil {
+		t.Fatal(err)
+	}
+	_, term, err := master.elect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step = func() map[int]db.Member {
+		for _, m := range managers {
+			if err := m.checkin(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, m := range managers {
+			members, err := m.members()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.resize(m == master, members); err != nil {
+				t.Fatal(err)
+			}
+		}
+		members, err := master.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := master.assignIndex(term, members); err != nil {
+			t.Fatal(err)
+		}
+		members, err = master.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range managers {
+			if err := m.updateServices(m == master, term, members); err != nil && !m.services.(*fakeServices).fail {
+				t.Fatal(err)
+			}
+		}
+		return sortByIndex(members)
+	}
+
+	sizes = func() map[int]int {
+		result := map[int]int{}
+		for _, m := range managers {
+			result[m.config.ClusterSize]++
+		}
+		return result
+	}
+
+	return managers, step, sizes
+}
+
+func TestResize(t *testing.T) {
+	store := db.NewMemoryStore()
+	_, step, sizes := resizeCluster(t, store, "a", "b", "c", "d", "e")
+
+	if byIndex := step(); len(byIndex) != 3 || sizes()[3] != 5 {
+		t.Fatalf("Expected 3 assigned indexes, got %d with sizes %v", len(byIndex), sizes())
+	}
+
+	if err := store.SetDesiredSize(5); err != nil {
+		t.Fatal(err)
+	}
+	if byIndex := step(); len(byIndex) != 5 || sizes()[3] != 5 {
+		t.Fatalf("Expected 5 assigned indexes before growing, got %d with sizes %v", len(byIndex), sizes())
+	}
+	for i := 1; i <= 5; i++ {
+		if step(); sizes()[5] != i {
+			t.Fatalf("Expected %d members to grow to 5 after %d steps, got sizes %v", i, i, sizes())
+		}
+	}
+	step()
+	if stepUUID, err := store.ResizeStep(); err != nil || stepUUID != "" {
+		t.Fatalf("Expected resize step to be cleared, got %q: %v", stepUUID, err)
+	}
+
+	if err := store.SetDesiredSize(3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if byIndex := step(); sizes()[3] != i || (i < 5 && len(byIndex) != 5) {
+			t.Fatalf("Expected %d members to shrink to 3 with 5 indexes, got %d indexes with sizes %v", i, len(byIndex), sizes())
+		}
+	}
+	if byIndex := step(); len(byIndex) != 3 {
+		t.Fatalf("Expected indexes to be released once every member shrank, got %d", len(byIndex))
+	}
+}
+
+func TestResizeWaitsForServices(t *testing.T) {
+	store := db.NewMemoryStore()
+	managers, step, sizes := resizeCluster(t, store, "a", "b", "c", "d", "e")
+	step()
+
+	if err := store.SetDesiredSize(5); err != nil {
+		t.Fatal(err)
+	}
+	step()
+	for _, m := range managers {
+		m.services.(*fakeServices).fail = true
+	}
+
+	// The first member switches its configuration, but zookeeper never comes up with the new size
+	step()
+	first, err := store.ResizeStep()
+	if err != nil || first == "" || sizes()[5] != 1 {
+		t.Fatalf("Expected one member to start resizing, got step %q with sizes %v: %v", first, sizes(), err)
+	}
+	for i := 0; i < 3; i++ {
+		step()
+	}
+	if current, err := store.ResizeStep(); err != nil || current != first || sizes()[5] != 1 {
+		t.Fatalf("Expected the step to stay on %s until its services run with the new size, got %q with sizes %v: %v",
+			first, current, sizes(), err)
+	}
+
+	for _, m := range managers {
+		m.services.(*fakeServices).fail = false
+	}
+	step()
+	step()
+	if current, err := store.ResizeStep(); err != nil || current == first || sizes()[5] != 2 {
+		t.Fatalf("Expected the step to move on once %s runs with the new size, got %q with sizes %v: %v", first, current, sizes(), err)
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	store := db.NewMemoryStore()
+	a := newTestManager("a", store)
+	b := newTestManager("b", store)
+
+	if master, _, err := a.elect(); err != nil || !master {
+		t.Fatalf("Expected a to become master: %v", err)
+	}
+
+	holder, err := StepDown(a.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder != "a" {
+		t.Fatalf("Expected a to step down, got %s", holder)
+	}
+
+	if master, _, err := a.elect(); err != nil || master {
+		t.Fatalf("Expected a to not reacquire the lease right after stepping down: %v", err)
+	}
+	if master, term, err := b.elect(); err != nil || !master || term != 2 {
+		t.Fatalf("Expected b to take over at term 2, got %t %d: %v", master, term, err)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	store := db.NewMemoryStore()
+	for _, uuid := range []string{"a", "b", "c"} {
+		checkin(t, store, uuid, 0, 0)
+	}
+
+	m := newTestManager("a", store)
+	if _, _, err := m.elect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reindex(m.config); err == nil {
+		t.Fatal("Expected reindex to fail while a master holds the lease")
+	}
+
+	if err := store.ReleaseLease("a"); err != nil {
+		t.Fatal(err)
+	}
+	// The managers are stopped, their heartbeats are stale
+	time.Sleep(m.config.HeartbeatTimeout() * 2)
+	if err := Reindex(m.config); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("Expected stopped members to be kept by reindex, got %d", len(members))
+	}
+	if byIndex := sortByIndex(members); len(byIndex) != 3 {
+		t.Fatalf("Expected 3 assigned indexes after reindex, got %d", len(byIndex))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	store := db.NewMemoryStore()
+	for _, uuid := range []string{"a", "b", "c"} {
+		checkin(t, store, uuid, 0, 0)
+	}
+
+	m := newTestManager("a", store)
+	m.config.ClusterSize = 1
+	_, term, err := m.elect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := func() map[int]db.Member {
+		members, err := m.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.assignIndex(term, members); err != nil {
+			t.Fatal(err)
+		}
+		members, err = m.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sortByIndex(members)
+	}
+
+	first := step()[1].UUID
+	if err := Drain(m.config, first, true); err != nil {
+		t.Fatal(err)
+	}
+
+	second := step()[1].UUID
+	if second == first || second == "" {
+		t.Fatalf("Expected index 1 to move from %s to a spare, got %s", first, second)
+	}
+
+	// No spare left, the index is held while its member drains
+	for _, uuid := range []string{"a", "b", "c"} {
+		if err := store.SetDraining(uuid, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if held := step()[1].UUID; held != second {
+		t.Fatalf("Expected %s to hold index 1 without a spare, got %s", second, held)
+	}
+}
+
+func TestAssignIndexSkipsUnhealthySpares(t *testing.T) {
+	store := db.NewMemoryStore()
+	checkin(t, store, "a", 1, 0)
+	for _, uuid := range []string{"b", "c", "d"} {
+		checkin(t, store, uuid, 0, 0)
+	}
+
+	m := newTestManager("a", store)
+	m.config.ClusterSize = 1
+	step := func() map[string]db.Member {
+		_, term, err := m.elect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		members, err := m.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.assignIndex(term, members); err != nil {
+			t.Fatal(err)
+		}
+		members, err = m.members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return members
+	}
+
+	if members := step(); members["a"].Index != 1 {
+		t.Fatalf("Expected a to get index 1, got %+v", members)
+	}
+
+	// b is the first spare but is shutting down, the draining index goes to c
+	if err := store.Leave("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Drain(m.config, "a", true); err != nil {
+		t.Fatal(err)
+	}
+	if members := step(); members["b"].Index != 0 || members["c"].Index != 1 {
+		t.Fatalf("Expected index 1 to skip leaving b and move to c, got %+v", members)
+	}
+
+	// d stopped checking in, the free indexes only go to a
+	time.Sleep(m.config.HeartbeatTimeout() * 2)
+	checkin(t, store, "a", 0, 0)
+	checkin(t, store, "c", 0, 0)
+	if err := Drain(m.config, "a", false); err != nil {
+		t.Fatal(err)
+	}
+	m.config.ClusterSize = 3
+	members := step()
+	if members["a"].Index == 0 || members["d"].Index != 0 {
+		t.Fatalf("Expected a to get a free index and stale d to get none, got %+v", members)
+	}
+}
+
+type unavailableStore struct {
+	*db.MemoryStore
+	down bool
+}
+
+func (u *unavailableStore) Ping() error {
+	if u.down {
+		return errors.New("Connection refused")
+	}
+	return nil
+}
+
+func (u *unavailableStore) Members() ([]db.Member, error) {
+	if err := u.Ping(); err != nil {
+		return nil, err
+	}
+	return u.MemoryStore.Members()
+}
+
+func TestDegraded(t *testing.T) {
+	store := &unavailableStore{MemoryStore: db.NewMemoryStore(), down: true}
+	m := newTestManager("a", store)
+	m.config.DBRetryMaxInterval = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.loop(ctx); err != nil {
+		t.Fatalf("Expected the loop to wait out the database, got %v", err)
+	}
+	if !m.Degraded() {
+		t.Fatal("Expected manager to be degraded")
+	}
+
+	checkin(t, store, "a", 0, 0)
+	checkin(t, store, "b", 0, 0)
+	time.Sleep(m.config.HeartbeatTimeout() * 2)
+	store.down = false
+	m.setDegraded(false)
+
+	lease, err := store.AcquireLease("a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := m.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.pruneMembers(lease.Term, members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected no members pruned right after the database came back, got %#v", members)
+	}
+}
+
+func TestRetireKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := db.NewMemoryStore()
+	m := newTestManager("a", store)
+	m.config.ConfigPath = dir
+	m.config.KeyringPath = "encryption.keyring"
+
+	keyring := &config.Keyring{}
+	old, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.config.SaveKeyring(keyring); err != nil {
+		t.Fatal(err)
+	}
+	m.config.KeyID = keyring.Active
+
+	store.Checkin(db.Member{UUID: "a", KeyID: keyring.Active}, 0)
+	store.Checkin(db.Member{UUID: "b", KeyID: old.ID}, 0)
+	members, _ := m.members()
+	m.retireKeys(members)
+	if m.keysRetired {
+		t.Fatal("Expected keys to be kept while a member reports an older key")
+	}
+
+	store.Checkin(db.Member{UUID: "b", KeyID: keyring.Active}, 1)
+	members, _ = m.members()
+	m.retireKeys(members)
+	if !m.keysRetired {
+		t.Fatal("Expected keys to be retired once every member reports the active key")
+	}
+
+	keyring, err = m.config.LoadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyring.Keys[0].Retired || keyring.Keys[1].Retired {
+		t.Fatalf("Expected only the old key to be retired, got %+v", keyring.Keys)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rancher/cluster-manager/cluster"
+	"github.com/rancher/cluster-manager/config"
+	"github.com/rancher/cluster-manager/db"
+)
+
+type command struct {
+	usage       string
+	description string
+	action      func(c *config.Config, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run": {
+			description: "Run the cluster manager (default)",
+			action: func(c *config.Config, args []string) error {
+				run(c)
+				return nil
+			},
+		},
+		"print-config": {
+			description: "Print the effective configuration with secrets redacted",
+			action:      printConfig,
+		},
+		"encrypt": {
+			usage:       "[VALUE]",
+			description: "Encrypt a setting such as CATTLE_DB_CATTLE_PASSWORD, read from stdin if not given",
+			action:      encrypt,
+		},
+		"rotate-key": {
+			description: "Add a new encryption key and re-encrypt CATTLE_DB_CATTLE_PASSWORD with it",
+			action:      rotateKey,
+		},
+		"validate": {
+			description: "Check the configuration and report every invalid setting",
+			action:      validate,
+		},
+		"status": {
+			description: "Print the cluster size, master and members",
+			action:      withDB(status),
+		},
+		"members": {
+			description: "Print the cluster members and their liveness",
+			action:      withDB(members),
+		},
+		"evict": {
+			usage:       "[-force] UUID",
+			description: "Remove a stopped member from the cluster",
+			action:      withDB(evict),
+		},
+		"step-down": {
+			description: "Make the current master give up its leader lease",
+			action:      withDB(stepDown),
+		},
+		"reindex": {
+			description: "Reassign all indexes, requires every cluster manager to be stopped",
+			action:      withDB(reindex),
+		},
+		"drain": {
+			usage:       "UUID",
+			description: "Move a member's index to a spare and stop its server and agent",
+			action:      withDB(drain(true)),
+		},
+		"undrain": {
+			usage:       "UUID",
+			description: "Release a drained member back into the cluster",
+			action:      withDB(drain(false)),
+		},
+		"resize": {
+			usage:       "SIZE",
+			description: "Change the desired cluster size",
+			action:      withDB(resize),
+		},
+	}
+}
+
+func runCommand(c *config.Config, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		return fmt.Errorf("Unknown command %s", name)
+	}
+	return cmd.action(c, args)
+}
+
+func usage() {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Usage: %s [COMMAND]\n\nCommands:\n", os.Args[0])
+	for _, name := range sortedKeys(commands) {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].usage, commands[name].description)
+	}
+	w.Flush()
+}
+
+func sortedKeys(m map[string]command) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func withDB(action func(c *config.Config, args []string) error) func(c *config.Config, args []string) error {
+	return func(c *config.Config, args []string) error {
+		if err := c.LoadConfig(); err != nil {
+			return err
+		}
+		if err := c.OpenDB(); err != nil {
+			return err
+		}
+		return action(c, args)
+	}
+}
+
+func printConfig(c *config.Config, args []string) error {
+	if err := c.LoadConfig(); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(c.Effective(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func encrypt(c *config.Config, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: encrypt [VALUE]")
+	}
+	if err := c.LoadConfig(); err != nil {
+		return err
+	}
+
+	var value string
+	if len(args) == 1 {
+		value = args[0]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+
+	encrypted, err := config.EncryptConfig(c, value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
+
+func rotateKey(c *config.Config, args []string) error {
+	if err := c.LoadConfig(); err != nil {
+		return err
+	}
+
+	keyring, err := c.LoadKeyring()
+	if err != nil {
+		return err
+	}
+	key, err := keyring.Rotate()
+	if err != nil {
+		return err
+	}
+	// Save the key first so nothing refers to a key that was never written
+	if err := c.SaveKeyring(keyring); err != nil {
+		return err
+	}
+	fmt.Printf("Rotated to encryption key %s\n", key.ID)
+
+	if c.DBPasswordFile != "" {
+		fmt.Printf("CATTLE_DB_CATTLE_PASSWORD is read in plain text from %s, nothing to re-encrypt\n", c.DBPasswordFile)
+	} else {
+		password, err := keyring.Encrypt(c.DBPassword)
+		if err != nil {
+			return err
+		}
+		inFile, err := c.SetFileSetting("CATTLE_DB_CATTLE_PASSWORD", password)
+		if err != nil {
+			return err
+		}
+
+		if inFile {
+			fmt.Printf("Re-encrypted CATTLE_DB_CATTLE_PASSWORD in %s\n", c.ConfigFile)
+		}
+		if !inFile || os.Getenv("CATTLE_DB_CATTLE_PASSWORD") != "" {
+			fmt.Printf("Set CATTLE_DB_CATTLE_PASSWORD=%s before restarting the manager\n", password)
+		}
+	}
+	fmt.Printf("Older keys are retired once every member has restarted and reports key %s\n", key.ID)
+	return nil
+}
+
+func validate(c *config.Config, args []string) error {
+	if err := c.LoadConfig(); err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func status(c *config.Config, args []string) error {
+	size, err := c.DB.DesiredSize()
+	if err != nil {
+		return err
+	}
+
+	lease, err := c.DB.Lease()
+	if err != nil {
+		return err
+	}
+
+	members, err := c.DB.Members()
+	if err != nil {
+		return err
+	}
+
+	live := 0
+	for _, member := range members {
+		if member.HeartbeatAge <= c.HeartbeatTimeout() {
+			live++
+		}
+	}
+
+	master := "none"
+	if lease.Holder != "" {
+		master = fmt.Sprintf("%s (term %d)", lease.Holder, lease.Term)
+	}
+
+	fmt.Printf("Cluster:      %s\n", c.ClusterID)
+	fmt.Printf("Database:     %s\n", c.DB.Endpoint())
+	fmt.Printf("Cluster size: %d\n", size)
+	fmt.Printf("Master:       %s\n", master)
+	fmt.Printf("Live members: %d\n\n", live)
+
+	return printMembers(c, lease, members)
+}
+
+func members(c *config.Config, args []string) error {
+	lease, err := c.DB.Lease()
+	if err != nil {
+		return err
+	}
+
+	members, err := c.DB.Members()
+	if err != nil {
+		return err
+	}
+
+	return printMembers(c, lease, members)
+}
+
+func printMembers(c *config.Config, lease db.Lease, members []db.Member) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "UUID\tNAME\tIP\tREQUESTED\tASSIGNED\tHEARTBEAT\tLIVE\tMASTER\tDRAINING\tLEAVING\tKEY")
+	for _, member := range members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%v ago\t%t\t%t\t%t\t%t\t%s\n", member.UUID, member.Name, member.IP, member.RequestedIndex,
+			member.Index, member.HeartbeatAge, member.HeartbeatAge <= c.HeartbeatTimeout(), member.UUID == lease.Holder,
+			member.Draining, member.Leaving, member.KeyID)
+	}
+	return w.Flush()
+}
+
+func evict(c *config.Config, args []string) error {
+	flags := flag.NewFlagSet("evict", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Evict even if the member is still checking in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: evict [-force] UUID")
+	}
+
+	if err := cluster.Evict(c, flags.Arg(0), *force); err != nil {
+		return err
+	}
+
+	fmt.Printf("Evicted %s\n", flags.Arg(0))
+	return nil
+}
+
+func stepDown(c *config.Config, args []string) error {
+	holder, err := cluster.StepDown(c)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s stepped down\n", holder)
+	return nil
+}
+
+func reindex(c *config.Config, args []string) error {
+	if err := cluster.Reindex(c); err != nil {
+		return err
+	}
+
+	return members(c, args)
+}
+
+func drain(draining bool) func(c *config.Config, args []string) error {
+	return func(c *config.Config, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: drain|undrain UUID")
+		}
+
+		if err := cluster.Drain(c, args[0], draining); err != nil {
+			return err
+		}
+
+		if draining {
+			fmt.Printf("%s is draining\n", args[0])
+		} else {
+			fmt.Printf("%s released from draining\n", args[0])
+		}
+		return nil
+	}
+}
+
+func resize(c *config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: resize SIZE")
+	}
+
+	size, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid size %s: %v", args[0], err)
+	}
+
+	if err := cluster.Resize(c, size); err != nil {
+		return err
+	}
+
+	fmt.Printf("Desired cluster size set to %d\n", size)
+	return nil
+}
@@ -2,9 +2,11 @@ package config
 
 import (
 	"fmt"
-	"os"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/go-sql-driver/mysql"
@@ -12,83 +14,215 @@ import (
 	"github.com/rancher/cluster-manager/docker"
 )
 
+const defaultPostgresPort = 5432
+
 type Config struct {
 	Image           string
+	ClusterID       string
 	ClusterIP       string
 	ClusterSize     int
 	ContainerPrefix string
 	ContainerEnv    map[string]string
 	DockerSocket    string
-	DB              *db.DB
+	DB              db.MembershipStore
+	DBType          string
 	DBHost          string
+	DBHosts         []string
 	DBName          string
 	DBPassword      string
+	DBPasswordFile  string
 	DBPort          int
 	DBUser          string
-	UUID            string
-	Ports           map[string]int
+
+	DBTimeout          time.Duration
+	DBMaxOpenConns     int
+	DBMaxIdleConns     int
+	DBConnMaxLifetime  time.Duration
+	DBStartupTimeout   time.Duration
+	DBRetryMaxInterval time.Duration
+
+	DBTLSMode       string
+	DBTLSCAPath     string
+	DBTLSCertPath   string
+	DBTLSKeyPath    string
+	DBTLSServerName string
+
+	// Java keystores for cattle, which cannot read PEM files when it connects to MySQL
+	DBTLSTrustStorePath       string
+	DBTLSKeyStorePath         string
+	DBTLSKeyStorePassword     string
+	DBTLSKeyStorePasswordFile string
+
+	UUID     string
+	UUIDPath string
+	Ports    map[string]int
+
+	HeartbeatInterval time.Duration
+	HeartbeatMissed   int
+	StopOnLeave       bool
+	LeaveGrace        time.Duration
+	StatusPort        int
 
 	SwarmEnabled bool
 	HTTPEnabled  bool
 
 	ConfigPath          string
+	ConfigFile          string
 	CertPath            string
 	KeyPath             string
 	CertChainPath       string
 	EncryptionKeyPath   string
+	KeyringPath         string
 	HostRegistrationURL string
 
 	HAEnabled bool
+
+	// KeyID is the encryption key that opened the database password, reported to the other members
+	KeyID string
+
+	// defaults is the configuration before anything was loaded, kept for reloads
+	defaults *Config
 }
 
 func (c *Config) LoadConfig() error {
+	if c.defaults == nil {
+		defaults := *c
+		c.defaults = &defaults
+	}
+
+	// The file location can only come from the environment
+	env := settings{}
+	env.setString(&c.ConfigPath, "CATTLE_HA_CONFIG_PATH")
+	env.setString(&c.ConfigFile, "CATTLE_HA_CONFIG_FILE")
+
+	s, err := loadFile(c.ConfigFilePath())
+	if err != nil {
+		return err
+	}
+
 	c.loadFromDocker()
 
-	setFromEnv(&c.Image, "CATTLE_HA_CLUSTER_IMAGE")
-	setFromEnv(&c.ClusterIP, "CATTLE_HA_CLUSTER_IP")
-	setFromEnvInt(&c.ClusterSize, "CATTLE_HA_CLUSTER_SIZE")
-	setFromEnv(&c.ContainerPrefix, "CATTLE_HA_CONTAINER_PREFIX")
-	setFromEnv(&c.DockerSocket, "HOST_DOCKER_SOCK")
+	s.setString(&c.Image, "CATTLE_HA_CLUSTER_IMAGE")
+	s.setString(&c.ClusterID, "CATTLE_HA_CLUSTER_ID")
+	s.setString(&c.ClusterIP, "CATTLE_HA_CLUSTER_IP")
+	if err := s.setInt(&c.ClusterSize, "CATTLE_HA_CLUSTER_SIZE"); err != nil {
+		return err
+	}
+	s.setString(&c.ContainerPrefix, "CATTLE_HA_CONTAINER_PREFIX")
+	s.setString(&c.DockerSocket, "HOST_DOCKER_SOCK")
+	if err := s.setDuration(&c.HeartbeatInterval, "CATTLE_HA_HEARTBEAT_INTERVAL"); err != nil {
+		return err
+	}
+	if err := s.setInt(&c.HeartbeatMissed, "CATTLE_HA_HEARTBEAT_MISSED"); err != nil {
+		return err
+	}
+	s.setBool(&c.StopOnLeave, "CATTLE_HA_STOP_ON_LEAVE")
+	if err := s.setDuration(&c.LeaveGrace, "CATTLE_HA_LEAVE_GRACE"); err != nil {
+		return err
+	}
+	if err := s.setInt(&c.StatusPort, "CATTLE_HA_STATUS_PORT"); err != nil {
+		return err
+	}
 
-	setFromEnv(&c.DBHost, "CATTLE_DB_CATTLE_MYSQL_HOST")
-	setFromEnvInt(&c.DBPort, "CATTLE_DB_CATTLE_MYSQL_PORT")
-	setFromEnv(&c.DBName, "CATTLE_DB_CATTLE_MYSQL_NAME")
-	setFromEnv(&c.DBUser, "CATTLE_DB_CATTLE_USERNAME")
-	setFromEnv(&c.DBPassword, "CATTLE_DB_CATTLE_PASSWORD")
+	s.setString(&c.DBType, "CATTLE_DB_CATTLE_DATABASE")
+	if c.DBType == db.Postgres {
+		c.DBPort = defaultPostgresPort
+		s.setString(&c.DBHost, "CATTLE_DB_CATTLE_POSTGRES_HOST")
+		if err := s.setInt(&c.DBPort, "CATTLE_DB_CATTLE_POSTGRES_PORT"); err != nil {
+			return err
+		}
+		s.setString(&c.DBName, "CATTLE_DB_CATTLE_POSTGRES_NAME")
+	} else {
+		s.setString(&c.DBHost, "CATTLE_DB_CATTLE_MYSQL_HOST")
+		if err := s.setInt(&c.DBPort, "CATTLE_DB_CATTLE_MYSQL_PORT"); err != nil {
+			return err
+		}
+		s.setString(&c.DBName, "CATTLE_DB_CATTLE_MYSQL_NAME")
+	}
+	s.setString(&c.DBUser, "CATTLE_DB_CATTLE_USERNAME")
+	if err := s.setSecret(&c.DBPassword, &c.DBPasswordFile, "CATTLE_DB_CATTLE_PASSWORD", c.ConfigPath); err != nil {
+		return err
+	}
+	s.setList(&c.DBHosts, "CATTLE_HA_DB_HOSTS")
+	if err := s.setDuration(&c.DBTimeout, "CATTLE_HA_DB_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := s.setInt(&c.DBMaxOpenConns, "CATTLE_HA_DB_MAX_OPEN_CONNS"); err != nil {
+		return err
+	}
+	if err := s.setInt(&c.DBMaxIdleConns, "CATTLE_HA_DB_MAX_IDLE_CONNS"); err != nil {
+		return err
+	}
+	if err := s.setDuration(&c.DBConnMaxLifetime, "CATTLE_HA_DB_CONN_MAX_LIFETIME"); err != nil {
+		return err
+	}
+	if err := s.setDuration(&c.DBStartupTimeout, "CATTLE_HA_DB_STARTUP_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := s.setDuration(&c.DBRetryMaxInterval, "CATTLE_HA_DB_RETRY_MAX_INTERVAL"); err != nil {
+		return err
+	}
+	s.setString(&c.DBTLSMode, "CATTLE_HA_DB_TLS_MODE")
+	s.setString(&c.DBTLSCAPath, "CATTLE_HA_DB_TLS_CA_PATH")
+	s.setString(&c.DBTLSCertPath, "CATTLE_HA_DB_TLS_CERT_PATH")
+	s.setString(&c.DBTLSKeyPath, "CATTLE_HA_DB_TLS_KEY_PATH")
+	s.setString(&c.DBTLSServerName, "CATTLE_HA_DB_TLS_SERVER_NAME")
+	s.setString(&c.DBTLSTrustStorePath, "CATTLE_HA_DB_TLS_TRUSTSTORE_PATH")
+	s.setString(&c.DBTLSKeyStorePath, "CATTLE_HA_DB_TLS_KEYSTORE_PATH")
+	err = s.setSecret(&c.DBTLSKeyStorePassword, &c.DBTLSKeyStorePasswordFile, "CATTLE_HA_DB_TLS_KEYSTORE_PASSWORD", c.ConfigPath)
+	if err != nil {
+		return err
+	}
 
-	setFromEnvBool(&c.SwarmEnabled, "CATTLE_HA_SWARM_ENABLED")
-	setFromEnvBool(&c.HTTPEnabled, "CATTLE_HA_HTTP_ENABLED")
+	s.setBool(&c.SwarmEnabled, "CATTLE_HA_SWARM_ENABLED")
+	s.setBool(&c.HTTPEnabled, "CATTLE_HA_HTTP_ENABLED")
 
-	setFromEnv(&c.ConfigPath, "CATTLE_HA_CONFIG_PATH")
-	setFromEnv(&c.CertPath, "CATTLE_HA_CERT_PATH")
-	setFromEnv(&c.KeyPath, "CATTLE_HA_KEY_PATH")
-	setFromEnv(&c.CertChainPath, "CATTLE_HA_CERT_CHAIN_PATH")
-	setFromEnv(&c.EncryptionKeyPath, "CATTLE_HA_ENCRYPTION_KEY_PATH")
-	setFromEnv(&c.HostRegistrationURL, "CATTLE_HA_HOST_REGISTRATION_URL")
+	s.setString(&c.CertPath, "CATTLE_HA_CERT_PATH")
+	s.setString(&c.KeyPath, "CATTLE_HA_KEY_PATH")
+	s.setString(&c.CertChainPath, "CATTLE_HA_CERT_CHAIN_PATH")
+	s.setString(&c.EncryptionKeyPath, "CATTLE_HA_ENCRYPTION_KEY_PATH")
+	s.setString(&c.KeyringPath, "CATTLE_HA_KEYRING_PATH")
+	s.setString(&c.HostRegistrationURL, "CATTLE_HA_HOST_REGISTRATION_URL")
+	s.setString(&c.UUIDPath, "CATTLE_HA_UUID_PATH")
 
-	setFromEnvBool(&c.HAEnabled, "CATTLE_HA_ENABLED")
+	s.setBool(&c.HAEnabled, "CATTLE_HA_ENABLED")
 
 	if c.Ports == nil {
 		c.Ports = map[string]int{}
 	}
 
-	for _, env := range os.Environ() {
-		if !strings.HasPrefix(env, "CATTLE_HA_PORT_") {
-			continue
-		}
-		keyValue := strings.SplitN(env, "=", 2)
-		key := strings.TrimPrefix(keyValue[0], "CATTLE_HA_PORT_")
+	for env, val := range s.withPrefix("CATTLE_HA_PORT_") {
+		key := strings.TrimPrefix(env, "CATTLE_HA_PORT_")
 		key = strings.ToLower(key)
 		key = strings.Replace(key, "_", "-", -1)
-		value, err := strconv.Atoi(keyValue[1])
+		value, err := strconv.Atoi(val)
 		if err != nil {
-			return fmt.Errorf("Failed to read %s as an integer: %v", env, err)
+			return fmt.Errorf("Failed to read %s=%s as an integer: %v", env, val, err)
 		}
 		c.Ports[key] = value
 	}
 
-	password, err := DecryptConfig(c, c.DBPassword)
-	c.DBPassword = password
+	if c.ClusterSize == 1 && c.ClusterIP == "" {
+		c.ClusterIP = "127.0.0.1"
+	}
+
+	if s.get("CATTLE_HA_UUID") != "" {
+		s.setString(&c.UUID, "CATTLE_HA_UUID")
+	} else if err := c.LoadUUID(); err != nil {
+		return err
+	}
+
+	keyring, err := c.LoadKeyring()
+	if err != nil {
+		return err
+	}
+
+	c.KeyID = ""
+	if c.DBPasswordFile != "" {
+		return nil
+	}
+	password, id, err := keyring.decrypt(c.DBPassword)
+	c.DBPassword, c.KeyID = password, id
 	return err
 }
 
@@ -96,15 +230,7 @@ func (c *Config) loadFromDocker() {
 	image, env, ok := docker.GetImageAndEnv()
 	if ok {
 		c.Image = image
-		c.ContainerEnv = env
-		for k := range env {
-			switch {
-			case k == "PATH":
-				delete(env, k)
-			case strings.Contains(k, "CATTLE_DB"):
-				delete(env, k)
-			}
-		}
+		c.ContainerEnv = inheritedEnv(env)
 	}
 
 	if c.ContainerEnv == nil {
@@ -115,30 +241,33 @@ func (c *Config) loadFromDocker() {
 		c.ContainerEnv["CATTLE_HA_ENCRYPTION_KEY_PATH"] = c.EncryptionKeyPath
 	}
 
-	c.ContainerEnv["CATTLE_HA_CONTAINER"] = "true"
-}
+	if _, ok := c.ContainerEnv["CATTLE_HA_KEYRING_PATH"]; !ok {
+		c.ContainerEnv["CATTLE_HA_KEYRING_PATH"] = c.KeyringPath
+	}
 
-func setFromEnvBool(target *bool, key string) {
-	val := os.Getenv(key)
-	*target = strings.EqualFold(val, "true")
+	c.ContainerEnv["CATTLE_HA_CONTAINER"] = "true"
 }
 
-func setFromEnvInt(target *int, key string) {
-	val := os.Getenv(key)
-	if val != "" {
-		s, err := strconv.Atoi(val)
-		if err != nil {
-			logrus.Fatalf("%s must be a number, got %s", key, val)
+// inheritedEnv drops the variables managed containers must not copy from the manager: database settings, which
+// cattle gets from DBEnv, and anything secret
+func inheritedEnv(env map[string]string) map[string]string {
+	for k := range env {
+		switch {
+		case k == "PATH":
+			delete(env, k)
+		case strings.Contains(k, "CATTLE_DB"):
+			delete(env, k)
+		case strings.HasPrefix(k, "CATTLE_HA_DB_TLS_"):
+			delete(env, k)
+		case docker.IsSecretEnv(k):
+			delete(env, k)
 		}
-		*target = s
 	}
+	return env
 }
 
-func setFromEnv(target *string, key string) {
-	val := os.Getenv(key)
-	if val != "" {
-		*target = val
-	}
+func (c *Config) HeartbeatTimeout() time.Duration {
+	return c.HeartbeatInterval * time.Duration(c.HeartbeatMissed)
 }
 
 func (c *Config) ZkHost() string {
@@ -165,22 +294,157 @@ func (c *Config) APIKeys() (string, string, error) {
 	return c.DB.APIKeys()
 }
 
+// DBEndpoints lists host and port of each database endpoint in order of preference
+func (c *Config) DBEndpoints() ([]string, error) {
+	if len(c.DBHosts) == 0 {
+		return []string{net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort))}, nil
+	}
+
+	result := []string{}
+	for _, host := range c.DBHosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, strconv.Itoa(c.DBPort))
+		}
+		if _, port, err := net.SplitHostPort(host); err != nil {
+			return nil, fmt.Errorf("Invalid database endpoint %s: %v", host, err)
+		} else if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("Invalid port in database endpoint %s", host)
+		}
+		result = append(result, host)
+	}
+	return result, nil
+}
+
+// activeDB returns the endpoint the manager is currently connected to
+func (c *Config) activeDB() (string, int) {
+	if c.DB != nil {
+		if host, port, err := net.SplitHostPort(c.DB.Endpoint()); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				return host, p
+			}
+		}
+	}
+	return c.DBHost, c.DBPort
+}
+
+// DBEnv returns the settings cattle needs to reach the same database, following the manager when it fails over.
+// The password is passed as a file so it never shows up in the container's environment.
+func (c *Config) DBEnv() (map[string]string, error) {
+	passwordFile, err := c.secretFile("db-password", c.DBPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port := c.activeDB()
+	env, err := c.cattleTLSEnv(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.DBType == db.Postgres {
+		env["CATTLE_DB_CATTLE_DATABASE"] = db.Postgres
+		env["CATTLE_DB_CATTLE_POSTGRES_HOST"] = host
+		env["CATTLE_DB_CATTLE_POSTGRES_PORT"] = strconv.Itoa(port)
+		env["CATTLE_DB_CATTLE_POSTGRES_NAME"] = c.DBName
+	} else {
+		env["CATTLE_DB_CATTLE_DATABASE"] = db.MySQL
+		env["CATTLE_DB_CATTLE_MYSQL_HOST"] = host
+		env["CATTLE_DB_CATTLE_MYSQL_PORT"] = strconv.Itoa(port)
+		env["CATTLE_DB_CATTLE_MYSQL_NAME"] = c.DBName
+	}
+	env["CATTLE_DB_CATTLE_USERNAME"] = c.DBUser
+	env["CATTLE_DB_CATTLE_PASSWORD_FILE"] = passwordFile
+	return env, nil
+}
+
+func (c *Config) dsn(endpoint string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	switch c.DBType {
+	case db.MySQL:
+		tlsConfig, err := c.mysqlTLS(host)
+		if err != nil {
+			return "", err
+		}
+
+		dsn := mysql.Config{
+			User:            c.DBUser,
+			Passwd:          c.DBPassword,
+			Net:             "tcp",
+			Addr:            endpoint,
+			DBName:          c.DBName,
+			Collation:       "utf8_general_ci",
+			Timeout:         c.DBTimeout,
+			ReadTimeout:     c.DBTimeout,
+			WriteTimeout:    c.DBTimeout,
+			ClientFoundRows: true,
+			TLSConfig:       tlsConfig,
+		}
+		return dsn.FormatDSN(), nil
+	case db.Postgres:
+		params, err := c.postgresTLS(host)
+		if err != nil {
+			return "", err
+		}
+		params.Set("connect_timeout", strconv.Itoa(int(c.DBTimeout/time.Second)))
+
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.DBUser, c.DBPassword),
+			Host:     endpoint,
+			Path:     "/" + c.DBName,
+			RawQuery: params.Encode(),
+		}
+		return dsn.String(), nil
+	}
+	return "", fmt.Errorf("CATTLE_DB_CATTLE_DATABASE must be %s or %s, got %s", db.MySQL, db.Postgres, c.DBType)
+}
+
 func (c *Config) OpenDB() error {
-	dsn := mysql.Config{
-		User:      c.DBUser,
-		Passwd:    c.DBPassword,
-		Net:       "tcp",
-		Addr:      fmt.Sprintf("%s:%d", c.DBHost, c.DBPort),
-		DBName:    c.DBName,
-		Collation: "utf8_general_ci",
+	names, err := c.DBEndpoints()
+	if err != nil {
+		return err
 	}
 
-	dbDef, err := db.New("mysql", dsn.FormatDSN())
+	endpoints := []db.Endpoint{}
+	for _, name := range names {
+		dsn, err := c.dsn(name)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, db.Endpoint{Name: name, DSN: dsn})
+	}
+
+	dbDef, err := db.New(c.DBType, endpoints, c.ClusterID)
 	if err != nil {
 		return err
 	}
+	dbDef.ConfigurePool(c.DBMaxOpenConns, c.DBMaxIdleConns, c.DBConnMaxLifetime)
 
-	c.DB = dbDef
+	backoff := db.Backoff{Initial: time.Second, Max: c.DBRetryMaxInterval}
+	deadline := time.Now().Add(c.DBStartupTimeout)
+	for {
+		err := dbDef.Ping()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Database unavailable after %v: %v", c.DBStartupTimeout, err)
+		}
+
+		wait := backoff.Next()
+		logrus.WithField("err", err).Warnf("Waiting %v for the database to become available", wait)
+		time.Sleep(wait)
+	}
 
-	return c.DB.Migrate()
+	logrus.Infof("Connected to database %s", dbDef.Endpoint())
+	if err := dbDef.Migrate(); err != nil {
+		return err
+	}
+
+	c.DB = dbDef
+	return nil
 }
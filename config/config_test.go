@@ -0,0 +1,48 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDBEndpoints(t *testing.T) {
+	c := &Config{DBHost: "mysql", DBPort: 3306}
+	endpoints, err := c.DBEndpoints()
+	if err != nil || !reflect.DeepEqual(endpoints, []string{"mysql:3306"}) {
+		t.Fatalf("Expected the single host, got %v %v", endpoints, err)
+	}
+
+	c.DBHosts = []string{"db1", "db2:3307", "[fd00::1]:3308"}
+	endpoints, err = c.DBEndpoints()
+	if err != nil || !reflect.DeepEqual(endpoints, []string{"db1:3306", "db2:3307", "[fd00::1]:3308"}) {
+		t.Fatalf("Unexpected endpoints %v %v", endpoints, err)
+	}
+
+	c.DBHosts = []string{"db1:port"}
+	if _, err := c.DBEndpoints(); err == nil {
+		t.Fatal("Expected an invalid port to be refused")
+	}
+}
+
+func TestInheritedEnv(t *testing.T) {
+	env := inheritedEnv(map[string]string{
+		"PATH":                                    "/usr/bin",
+		"CATTLE_DB_CATTLE_PASSWORD":               "cattle",
+		"CATTLE_DB_CATTLE_PASSWORD_FILE":          "password",
+		"CATTLE_HA_DB_TLS_KEYSTORE_PASSWORD":      "changeit",
+		"CATTLE_HA_DB_TLS_KEYSTORE_PASSWORD_FILE": "keystore-password",
+		"CATTLE_HA_DB_TLS_KEY_PATH":               "key.pem",
+		"CATTLE_HA_ENCRYPTION_KEY":                "s3cret",
+		"REGISTRY_TOKEN":                          "abc",
+		"CATTLE_HA_KEYRING_PATH":                  "encryption.keyring",
+		"CATTLE_HA_CLUSTER_SIZE":                  "3",
+	})
+
+	expected := map[string]string{
+		"CATTLE_HA_KEYRING_PATH": "encryption.keyring",
+		"CATTLE_HA_CLUSTER_SIZE": "3",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Expected only non-secret settings to reach managed containers, got %v", env)
+	}
+}
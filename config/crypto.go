@@ -3,61 +3,155 @@ package config
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
 	"path"
 	"strings"
 )
 
-func DecryptConfig(c *Config, encrypted string) (string, error) {
+// v2Prefix marks values sealed with AES-GCM, older values are AES-CBC as iv:data in hex
+const v2Prefix = "v2:"
+
+var ErrInvalidCiphertext = errors.New("Encrypted value is corrupt or was not encrypted with this key")
+
+func (c *Config) readEncryptionKey() (string, error) {
 	keyBytes, err := ioutil.ReadFile(path.Join(c.ConfigPath, c.EncryptionKeyPath))
-	if os.IsNotExist(err) {
-		return encrypted, nil
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(string(keyBytes)), nil
+}
 
-	return Decrypt(encrypted, string(keyBytes))
+func DecryptConfig(c *Config, encrypted string) (string, error) {
+	keyring, err := c.LoadKeyring()
+	if err != nil {
+		return "", err
+	}
+	return keyring.Decrypt(encrypted)
 }
 
-func Decrypt(encrypted string, key string) (string, error) {
-	if key == "" {
-		return encrypted, nil
+func EncryptConfig(c *Config, plain string) (string, error) {
+	keyring, err := c.LoadKeyring()
+	if err != nil {
+		return "", err
+	}
+	if len(keyring.Keys) == 0 {
+		return "", fmt.Errorf("No encryption key at %s or %s", c.keyringFile(), path.Join(c.ConfigPath, c.EncryptionKeyPath))
 	}
+	return keyring.Encrypt(plain)
+}
 
+func newBlock(key string) (cipher.Block, error) {
 	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("Encryption key is not valid base64: %v", err)
+	}
+	return aes.NewCipher(keyBytes)
+}
+
+func Encrypt(plain string, key string) (string, error) {
+	block, err := newBlock(key)
 	if err != nil {
 		return "", err
 	}
 
-	parts := strings.SplitN(encrypted, ":", 2)
-	iv, err := hex.DecodeString(parts[0])
+	sealed, err := sealGCM(block, plain)
 	if err != nil {
 		return "", err
 	}
+	return v2Prefix + sealed, nil
+}
 
-	data, err := hex.DecodeString(parts[1])
+func sealGCM(block cipher.Block, plain string) (string, error) {
+	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(keyBytes)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func Decrypt(encrypted string, key string) (string, error) {
+	if key == "" {
+		return encrypted, nil
+	}
+
+	block, err := newBlock(key)
 	if err != nil {
 		return "", err
 	}
 
-	blockMode := cipher.NewCBCDecrypter(block, iv)
+	if strings.HasPrefix(encrypted, v2Prefix) {
+		return decryptGCM(block, strings.TrimPrefix(encrypted, v2Prefix))
+	}
+	return decryptCBC(block, encrypted)
+}
+
+func decryptGCM(block cipher.Block, encrypted string) (string, error) {
+	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return "", err
 	}
 
-	blockMode.CryptBlocks(data, data)
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
 
-	return string(PKCS5UnPadding(data)), nil
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plain), nil
 }
 
-func PKCS5UnPadding(src []byte) []byte {
+func decryptCBC(block cipher.Block, encrypted string) (string, error) {
+	parts := strings.SplitN(encrypted, ":", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidCiphertext
+	}
+
+	iv, err := hex.DecodeString(parts[0])
+	if err != nil || len(iv) != block.BlockSize() {
+		return "", ErrInvalidCiphertext
+	}
+
+	data, err := hex.DecodeString(parts[1])
+	if err != nil || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return "", ErrInvalidCiphertext
+	}
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	plain, err := PKCS5UnPadding(data, block.BlockSize())
+	return string(plain), err
+}
+
+// PKCS5UnPadding strips the padding after checking every padding byte, since CBC values are not authenticated
+func PKCS5UnPadding(src []byte, blockSize int) ([]byte, error) {
 	length := len(src)
+	if length == 0 {
+		return nil, ErrInvalidCiphertext
+	}
+
 	unpadding := int(src[length-1])
-	return src[:(length - unpadding)]
+	if unpadding == 0 || unpadding > blockSize || unpadding > length {
+		return nil, ErrInvalidCiphertext
+	}
+	for _, b := range src[length-unpadding:] {
+		if int(b) != unpadding {
+			return nil, ErrInvalidCiphertext
+		}
+	}
+	return src[:length-unpadding], nil
 }
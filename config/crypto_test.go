@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestDecrypt(t *testing.T) {
 	key := "+CYp6SnbG6v14/g136kdnx5oEOt34+aIOJrVpxSkMrA="
@@ -13,3 +16,39 @@ func TestDecrypt(t *testing.T) {
 		t.Fatal("Failed to decrypt")
 	}
 }
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := "+CYp6SnbG6v14/g136kdnx5oEOt34+aIOJrVpxSkMrA="
+	encrypted, err := Encrypt("cattle", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, v2Prefix) {
+		t.Fatalf("Expected a %s value, got %s", v2Prefix, encrypted)
+	}
+
+	decrypted, err := Decrypt(encrypted, key)
+	if err != nil || decrypted != "cattle" {
+		t.Fatalf("Failed to decrypt %s: %v", decrypted, err)
+	}
+
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if _, err := Decrypt(tampered, key); err != ErrInvalidCiphertext {
+		t.Fatalf("Expected tampering to be detected, got %v", err)
+	}
+}
+
+func TestDecryptCorrupt(t *testing.T) {
+	key := "+CYp6SnbG6v14/g136kdnx5oEOt34+aIOJrVpxSkMrA="
+	for _, encrypted := range []string{
+		"cattle",
+		"c6adb7742a44cac7d52dbea2a7403522:",
+		"c6adb7742a44cac7d52dbea2a7403522:a40af19d80e55cdd",
+		"c6adb7742a44cac7d52dbea2a7403522:a40af19d80e55cdd4d9ff8fb6199416f",
+		"v2:",
+	} {
+		if _, err := Decrypt(encrypted, key); err != ErrInvalidCiphertext {
+			t.Errorf("Expected %q to be rejected, got %v", encrypted, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/rancher/cluster-manager/docker"
+)
+
+const redacted = docker.Redacted
+
+var secretFields = map[string]bool{
+	"DBPassword":            true,
+	"DBTLSKeyStorePassword": true,
+}
+
+// Effective returns the resolved settings for display, with secrets redacted
+func (c *Config) Effective() map[string]interface{} {
+	result := map[string]interface{}{}
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		field := v.Field(i)
+		switch {
+		case v.Type().Field(i).PkgPath != "" || field.Kind() == reflect.Interface:
+		case secretFields[name]:
+			if field.String() != "" {
+				result[name] = redacted
+			} else {
+				result[name] = ""
+			}
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			result[name] = time.Duration(field.Int()).String()
+		default:
+			result[name] = field.Interface()
+		}
+	}
+
+	result["ContainerEnv"] = RedactEnv(c.ContainerEnv)
+	result["ZkHosts"] = c.ZkHosts()
+	result["RedisHosts"] = c.RedisHosts()
+	return result
+}
+
+// RedactEnv hides the values of environment variables that look like credentials
+func RedactEnv(env map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, value := range env {
+		result[key] = docker.RedactEnvValue(key, value)
+	}
+	return result
+}
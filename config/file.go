@@ -0,0 +1,157 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settings resolves each setting from the environment, falling back to the config file
+type settings struct {
+	file map[string]string
+}
+
+// loadFile reads the optional JSON config file. Its keys are the environment variable names, so a
+// setting can move between the file and the environment unchanged.
+func loadFile(file string) (settings, error) {
+	s := settings{file: map[string]string{}}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	defer f.Close()
+
+	values := map[string]interface{}{}
+	if err := json.NewDecoder(f).Decode(&values); err != nil {
+		return s, fmt.Errorf("Failed to parse %s: %v", file, err)
+	}
+
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			s.file[key] = v
+		case bool:
+			s.file[key] = strconv.FormatBool(v)
+		case float64:
+			s.file[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case []interface{}:
+			items := []string{}
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			s.file[key] = strings.Join(items, ",")
+		default:
+			return s, fmt.Errorf("Unsupported value for %s in %s", key, file)
+		}
+	}
+
+	return s, nil
+}
+
+// SetFileSetting replaces a setting that is already present in the config file and reports whether it was
+func (c *Config) SetFileSetting(key, value string) (bool, error) {
+	content, err := ioutil.ReadFile(c.ConfigFilePath())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return false, fmt.Errorf("Failed to parse %s: %v", c.ConfigFilePath(), err)
+	}
+	if _, ok := values[key]; !ok {
+		return false, nil
+	}
+
+	values[key] = value
+	content, err = json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(c.ConfigFilePath(), append(content, '\n'), 0600)
+}
+
+func (c *Config) ConfigFilePath() string {
+	if path.IsAbs(c.ConfigFile) {
+		return c.ConfigFile
+	}
+	return path.Join(c.ConfigPath, c.ConfigFile)
+}
+
+func (s settings) get(key string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return s.file[key]
+}
+
+// withPrefix returns every setting whose key starts with prefix, environment taking precedence
+func (s settings) withPrefix(prefix string) map[string]string {
+	result := map[string]string{}
+	for key, val := range s.file {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = val
+		}
+	}
+	for _, env := range os.Environ() {
+		if keyValue := strings.SplitN(env, "=", 2); strings.HasPrefix(keyValue[0], prefix) {
+			result[keyValue[0]] = keyValue[1]
+		}
+	}
+	return result
+}
+
+func (s settings) setString(target *string, key string) {
+	if val := s.get(key); val != "" {
+		*target = val
+	}
+}
+
+func (s settings) setBool(target *bool, key string) {
+	if val := s.get(key); val != "" {
+		*target = strings.EqualFold(val, "true")
+	}
+}
+
+func (s settings) setInt(target *int, key string) error {
+	if val := s.get(key); val != "" {
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %s", key, val)
+		}
+		*target = i
+	}
+	return nil
+}
+
+func (s settings) setDuration(target *time.Duration, key string) error {
+	if val := s.get(key); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 5s, got %s", key, val)
+		}
+		*target = d
+	}
+	return nil
+}
+
+func (s settings) setList(target *[]string, key string) {
+	if val := s.get(key); val != "" {
+		*target = nil
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadFilePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "config.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"CATTLE_HA_CLUSTER_SIZE": 5,
+		"CATTLE_HA_HEARTBEAT_INTERVAL": "10s",
+		"CATTLE_HA_STOP_ON_LEAVE": true,
+		"CATTLE_HA_DB_HOSTS": ["db1", "db2:3307"],
+		"CATTLE_HA_CONTAINER_PREFIX": "from-file-"
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CATTLE_HA_CONTAINER_PREFIX", "from-env-")
+	defer os.Unsetenv("CATTLE_HA_CONTAINER_PREFIX")
+
+	s, err := loadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{ClusterSize: 3, HeartbeatMissed: 2, ContainerPrefix: "default-"}
+	s.setInt(&c.ClusterSize, "CATTLE_HA_CLUSTER_SIZE")
+	s.setInt(&c.HeartbeatMissed, "CATTLE_HA_HEARTBEAT_MISSED")
+	s.setDuration(&c.HeartbeatInterval, "CATTLE_HA_HEARTBEAT_INTERVAL")
+	s.setBool(&c.StopOnLeave, "CATTLE_HA_STOP_ON_LEAVE")
+	s.setList(&c.DBHosts, "CATTLE_HA_DB_HOSTS")
+	s.setString(&c.ContainerPrefix, "CATTLE_HA_CONTAINER_PREFIX")
+
+	if c.ClusterSize != 5 || c.HeartbeatInterval != 10*time.Second || !c.StopOnLeave {
+		t.Fatalf("Expected file values, got %+v", c)
+	}
+	if c.HeartbeatMissed != 2 {
+		t.Fatalf("Expected default to be kept, got %d", c.HeartbeatMissed)
+	}
+	if !reflect.DeepEqual(c.DBHosts, []string{"db1", "db2:3307"}) {
+		t.Fatalf("Unexpected hosts %v", c.DBHosts)
+	}
+	if c.ContainerPrefix != "from-env-" {
+		t.Fatalf("Expected environment to win, got %s", c.ContainerPrefix)
+	}
+
+	if _, err := loadFile(path.Join(dir, "missing.json")); err != nil {
+		t.Fatalf("Expected a missing file to be ignored, got %v", err)
+	}
+}
+
+func TestEffectiveRedactsSecrets(t *testing.T) {
+	c := &Config{
+		ClusterSize:       2,
+		DBPassword:        "cattle",
+		HeartbeatInterval: 5 * time.Second,
+		ContainerEnv: map[string]string{
+			"CATTLE_HA_ENCRYPTION_KEY_PATH": "server/encryption.key",
+			"CATTLE_SECRET_KEY":             "secret",
+		},
+	}
+
+	effective := c.Effective()
+	if effective["DBPassword"] != redacted || effective["HeartbeatInterval"] != "5s" {
+		t.Fatalf("Unexpected effective config %v", effective)
+	}
+	env := effective["ContainerEnv"].(map[string]string)
+	if env["CATTLE_SECRET_KEY"] != redacted || env["CATTLE_HA_ENCRYPTION_KEY_PATH"] != "server/encryption.key" {
+		t.Fatalf("Unexpected container env %v", env)
+	}
+	if effective["ZkHosts"] != "localhost:2181,localhost:2182" {
+		t.Fatalf("Unexpected zookeeper hosts %v", effective["ZkHosts"])
+	}
+}
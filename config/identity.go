@@ -0,0 +1,42 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/cluster-manager/docker"
+)
+
+func (c *Config) LoadUUID() error {
+	if c.UUIDPath == "" {
+		return nil
+	}
+
+	uuidFile := path.Join(c.ConfigPath, c.UUIDPath)
+	content, err := ioutil.ReadFile(uuidFile)
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		c.UUID = strings.TrimSpace(string(content))
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(uuidFile), 0700); err == nil {
+		if err := ioutil.WriteFile(uuidFile, []byte(c.UUID+"\n"), 0600); err == nil {
+			logrus.Infof("Generated cluster member UUID %s in %s", c.UUID, uuidFile)
+			return nil
+		}
+	}
+
+	if id, err := docker.EngineID(); err == nil && id != "" {
+		logrus.Infof("Can not write %s, using docker engine ID %s as cluster member UUID", uuidFile, id)
+		c.UUID = id
+		return nil
+	}
+
+	logrus.Warnf("Can not write %s, cluster member UUID %s will change on restart", uuidFile, c.UUID)
+	return nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{
+		UUID:       "first",
+		ConfigPath: dir,
+		UUIDPath:   "cluster/uuid",
+	}
+	if err := c.LoadUUID(); err != nil {
+		t.Fatal(err)
+	}
+	if c.UUID != "first" {
+		t.Fatalf("Expected generated UUID to be kept, got %s", c.UUID)
+	}
+
+	restarted := &Config{
+		UUID:       "second",
+		ConfigPath: dir,
+		UUIDPath:   "cluster/uuid",
+	}
+	if err := restarted.LoadUUID(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.UUID != "first" {
+		t.Fatalf("Expected UUID to survive a restart, got %s", restarted.UUID)
+	}
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// v3Prefix marks AES-GCM values that name their key, as v3:<key id>:<data>
+	v3Prefix = "v3:"
+	keySize  = 32
+)
+
+type Key struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	Retired bool      `json:"retired,omitempty"`
+}
+
+type Keyring struct {
+	Active string `json:"active"`
+	// Legacy is the key from the single key file, which sealed every value without an ID
+	Legacy string `json:"legacy,omitempty"`
+	Keys   []Key  `json:"keys"`
+}
+
+// keyID names a key after its material, so keys rotated on different hosts never share an ID
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *Keyring) key(id string) (Key, bool) {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+func (k *Keyring) Encrypt(plain string) (string, error) {
+	key, ok := k.key(k.Active)
+	if !ok {
+		return "", fmt.Errorf("Active encryption key %q is not in the keyring", k.Active)
+	}
+
+	block, err := newBlock(key.Key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealGCM(block, plain)
+	if err != nil {
+		return "", err
+	}
+	return v3Prefix + key.ID + ":" + sealed, nil
+}
+
+// Decrypt picks the key named by the value, values without a key ID belong to the legacy key.
+// Without any key values are returned unchanged.
+func (k *Keyring) Decrypt(encrypted string) (string, error) {
+	plain, _, err := k.decrypt(encrypted)
+	return plain, err
+}
+
+// decrypt also returns the ID of the key that opened the value, empty when no key was needed
+func (k *Keyring) decrypt(encrypted string) (string, string, error) {
+	if len(k.Keys) == 0 {
+		return encrypted, "", nil
+	}
+
+	id := k.Legacy
+	if strings.HasPrefix(encrypted, v3Prefix) {
+		parts := strings.SplitN(strings.TrimPrefix(encrypted, v3Prefix), ":", 2)
+		if len(parts) != 2 {
+			return "", "", ErrInvalidCiphertext
+		}
+		id = parts[0]
+		encrypted = v2Prefix + parts[1]
+	} else if id == "" {
+		return "", "", errors.New("Value names no encryption key and the keyring has no legacy key")
+	}
+
+	key, ok := k.key(id)
+	if !ok {
+		return "", "", fmt.Errorf("Value was encrypted with key %s, which is not in the keyring", id)
+	}
+	if key.Retired {
+		return "", "", fmt.Errorf("Value was encrypted with retired key %s, encrypt it again with key %s", id, k.Active)
+	}
+	plain, err := Decrypt(encrypted, key.Key)
+	return plain, id, err
+}
+
+// Rotate adds a new key and makes it active. Older keys stay usable until they are retired.
+func (k *Keyring) Rotate() (Key, error) {
+	raw := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return Key{}, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	key := Key{
+		ID:      keyID(encoded),
+		Key:     encoded,
+		Created: time.Now().UTC(),
+	}
+	k.Keys = append(k.Keys, key)
+	k.Active = key.ID
+	return key, nil
+}
+
+// retireInactive retires every key but the active one and returns the IDs it retired
+func (k *Keyring) retireInactive() []string {
+	retired := []string{}
+	for i, key := range k.Keys {
+		if key.ID != k.Active && !key.Retired {
+			k.Keys[i].Retired = true
+			retired = append(retired, key.ID)
+		}
+	}
+	return retired
+}
+
+func (c *Config) keyringFile() string {
+	return path.Join(c.ConfigPath, c.KeyringPath)
+}
+
+// LoadKeyring reads the keyring, or builds one from the single key file if no keyring was created yet
+func (c *Config) LoadKeyring() (*Keyring, error) {
+	content, err := ioutil.ReadFile(c.keyringFile())
+	if os.IsNotExist(err) {
+		key, err := c.readEncryptionKey()
+		if os.IsNotExist(err) {
+			return &Keyring{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		return &Keyring{Active: id, Legacy: id, Keys: []Key{{ID: id, Key: key}}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{}
+	if err := json.Unmarshal(content, keyring); err != nil {
+		return nil, fmt.Errorf("Failed to parse keyring %s: %v", c.keyringFile(), err)
+	}
+	if _, ok := keyring.key(keyring.Active); !ok {
+		return nil, fmt.Errorf("Active key %q is missing from keyring %s", keyring.Active, c.keyringFile())
+	}
+	return keyring, nil
+}
+
+func (c *Config) SaveKeyring(keyring *Keyring) error {
+	content, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.keyringFile(), content, 0600)
+}
+
+// RetireKeys retires the keys replaced by the active one, call it once every member reports the active key
+func (c *Config) RetireKeys() ([]string, error) {
+	if _, err := os.Stat(c.keyringFile()); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	keyring, err := c.LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if keyring.Active != c.KeyID {
+		// Rotated again since this manager started or its password is still sealed with an older key,
+		// wait for members to report the newer key
+		return nil, nil
+	}
+
+	retired := keyring.retireInactive()
+	if len(retired) == 0 {
+		return nil, nil
+	}
+	return retired, c.SaveKeyring(keyring)
+}
+
+func writeFileAtomic(file string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
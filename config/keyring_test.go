@@ -0,0 +1,81 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{
+		ConfigPath:        dir,
+		EncryptionKeyPath: "encryption.key",
+		KeyringPath:       "encryption.keyring",
+	}
+
+	legacy := "+CYp6SnbG6v14/g136kdnx5oEOt34+aIOJrVpxSkMrA="
+	if err := ioutil.WriteFile(path.Join(dir, c.EncryptionKeyPath), []byte(legacy+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := c.LoadKeyring()
+	if err != nil || keyring.Active != keyring.Legacy || keyring.Active != keyID(legacy) {
+		t.Fatalf("Expected the legacy key to be active, got %+v %v", keyring, err)
+	}
+
+	key, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveKeyring(keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	if key.ID != keyID(key.Key) || key.ID == keyring.Legacy {
+		t.Fatalf("Expected the key ID to be derived from the new key, got %s", key.ID)
+	}
+
+	keyring, err = c.LoadKeyring()
+	if err != nil || keyring.Active != key.ID {
+		t.Fatalf("Expected key %s to be active, got %+v %v", key.ID, keyring, err)
+	}
+
+	encrypted, err := keyring.Encrypt("cattle")
+	if err != nil || !strings.HasPrefix(encrypted, v3Prefix+key.ID+":") {
+		t.Fatalf("Expected a value naming key %s, got %s %v", key.ID, encrypted, err)
+	}
+
+	for value, id := range map[string]string{
+		encrypted: key.ID,
+		"c6adb7742a44cac7d52dbea2a7403522:a40af19d80e55cdd4d9ff8fb6199416e": keyring.Legacy,
+	} {
+		if decrypted, used, err := keyring.decrypt(value); err != nil || decrypted != "cattle" || used != id {
+			t.Fatalf("Failed to decrypt %s with key %s: %s %s %v", value, id, decrypted, used, err)
+		}
+	}
+
+	c.KeyID = key.ID
+	retired, err := c.RetireKeys()
+	if err != nil || len(retired) != 1 || retired[0] != keyID(legacy) {
+		t.Fatalf("Expected the legacy key to be retired, got %v %v", retired, err)
+	}
+
+	keyring, err = c.LoadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Decrypt("c6adb7742a44cac7d52dbea2a7403522:a40af19d80e55cdd4d9ff8fb6199416e"); err == nil {
+		t.Fatal("Expected a value sealed with a retired key to be refused")
+	}
+	if decrypted, err := keyring.Decrypt(encrypted); err != nil || decrypted != "cattle" {
+		t.Fatalf("Failed to decrypt with the active key: %s %v", decrypted, err)
+	}
+}
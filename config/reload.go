@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reloadable are the settings a running manager picks up, everything else needs a restart
+var reloadable = map[string]bool{
+	"Image":               true,
+	"Ports":               true,
+	"ContainerEnv":        true,
+	"HostRegistrationURL": true,
+	"HAEnabled":           true,
+	"StopOnLeave":         true,
+	"LeaveGrace":          true,
+	"KeyID":               true,
+}
+
+var restartReasons = map[string]string{
+	"ClusterID": "it names the cluster this member belongs to",
+	"ClusterIP": "other members reach this one by it",
+	"UUID":      "it identifies this member",
+}
+
+// Change is a setting that differs between two configurations, with secrets redacted
+type Change struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// Reload loads the configuration again on top of the original defaults and reports what changed
+func (c *Config) Reload() (*Config, []Change, error) {
+	if c.defaults == nil {
+		return nil, nil, errors.New("Configuration was never loaded")
+	}
+
+	next := *c.defaults
+	if err := next.LoadConfig(); err != nil {
+		return nil, nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, nil, err
+	}
+	// The running size follows the resize command, CATTLE_HA_CLUSTER_SIZE only seeds it
+	next.ClusterSize = c.ClusterSize
+	return &next, c.Diff(&next), nil
+}
+
+func (c *Config) Diff(next *Config) []Change {
+	changes := []Change{}
+	oldValues, newValues := c.Effective(), next.Effective()
+
+	oldValue, newValue := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" || field.Type.Kind() == reflect.Interface {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changes = append(changes, Change{
+				Field: field.Name,
+				Old:   oldValues[field.Name],
+				New:   newValues[field.Name],
+			})
+		}
+	}
+	return changes
+}
+
+// Apply copies the changed settings from next, unless one of them can't change while the manager runs
+func (c *Config) Apply(next *Config, changes []Change) error {
+	unsafe := []string{}
+	for _, change := range changes {
+		if reloadable[change.Field] {
+			continue
+		}
+		reason := restartReasons[change.Field]
+		if reason == "" {
+			reason = "it requires a restart"
+		}
+		unsafe = append(unsafe, fmt.Sprintf("%s (%s)", change.Field, reason))
+	}
+	if len(unsafe) > 0 {
+		return fmt.Errorf("Can't change %s while running", strings.Join(unsafe, ", "))
+	}
+
+	target, source := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for _, change := range changes {
+		target.FieldByName(change.Field).Set(source.FieldByName(change.Field))
+	}
+	return nil
+}
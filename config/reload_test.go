@@ -0,0 +1,105 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rancher/cluster-manager/db"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "config.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{
+		ClusterID:          db.DefaultCluster,
+		ClusterSize:        3,
+		HeartbeatInterval:  5 * time.Second,
+		HeartbeatMissed:    2,
+		DBType:             db.MySQL,
+		DBHost:             "mysql",
+		DBPort:             3306,
+		DBPassword:         "cattle",
+		DBTimeout:          10 * time.Second,
+		DBStartupTimeout:   5 * time.Minute,
+		DBRetryMaxInterval: 30 * time.Second,
+		ConfigPath:         dir,
+		ConfigFile:         "config.json",
+		UUIDPath:           "uuid",
+		EncryptionKeyPath:  "encryption.key",
+		KeyringPath:        "encryption.keyring",
+	}
+
+	write(`{"CATTLE_HA_CLUSTER_IP": "10.0.0.1"}`)
+	if err := c.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`{"CATTLE_HA_CLUSTER_IP": "10.0.0.1", "CATTLE_HA_PORT_REDIS": 7000,
+		"CATTLE_HA_HOST_REGISTRATION_URL": "https://rancher.example.com"}`)
+	next, changes, err := c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Field != "Ports" || changes[1].Field != "HostRegistrationURL" {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+	if err := c.Apply(next, changes); err != nil {
+		t.Fatal(err)
+	}
+	if c.Ports[db.Redis] != 7000 || c.HostRegistrationURL != "https://rancher.example.com" {
+		t.Fatalf("Expected the changes to be applied, got %+v", c)
+	}
+
+	write(`{"CATTLE_HA_CLUSTER_IP": "10.0.0.2", "CATTLE_DB_CATTLE_PASSWORD": "changed"}`)
+	next, changes, err = c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		if change.Field == "DBPassword" && (change.Old != redacted || change.New != redacted) {
+			t.Fatalf("Expected the password to be redacted, got %+v", change)
+		}
+	}
+	if err := c.Apply(next, changes); err == nil {
+		t.Fatal("Expected changing the cluster IP and database password to be rejected")
+	}
+	if c.ClusterIP != "10.0.0.1" || c.Ports[db.Redis] != 7000 {
+		t.Fatalf("Expected a rejected reload to change nothing, got %+v", c)
+	}
+
+	// Resized while running, the configured size must not block reloads
+	c.ClusterSize = 5
+	write(`{"CATTLE_HA_CLUSTER_IP": "10.0.0.1", "CATTLE_HA_PORT_REDIS": 7000,
+		"CATTLE_HA_HOST_REGISTRATION_URL": "https://rancher.example.com", "CATTLE_HA_STOP_ON_LEAVE": true}`)
+	next, changes, err = c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(next, changes); err != nil || c.ClusterSize != 5 || !c.StopOnLeave {
+		t.Fatalf("Expected the reload to keep the running cluster size, got %d: %v", c.ClusterSize, err)
+	}
+
+	write(`{"CATTLE_HA_CLUSTER_SIZE": 2}`)
+	if _, _, err := c.Reload(); err == nil {
+		t.Fatal("Expected an invalid configuration to be rejected")
+	}
+
+	write(`{"CATTLE_HA_CLUSTER_IP": "10.0.0.1", "CATTLE_HA_HEARTBEAT_MISSED": "two"}`)
+	if _, _, err := c.Reload(); err == nil {
+		t.Fatal("Expected a malformed number to be returned as an error")
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rancher/cluster-manager/docker"
+)
+
+// secretsDir holds secrets handed to managed containers, under the config directory they all mount
+const secretsDir = "cluster/secrets"
+
+// setSecret reads a secret from the setting or, when KEY_FILE is set, from that file. Secrets read from a
+// file are taken as plain text, fileTarget records which file was used.
+func (s settings) setSecret(target, fileTarget *string, key, configPath string) error {
+	file := s.get(key + "_FILE")
+	if file == "" {
+		s.setString(target, key)
+		return nil
+	}
+
+	if !path.IsAbs(file) {
+		file = path.Join(configPath, file)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s_FILE: %v", key, err)
+	}
+	*target = strings.TrimRight(string(content), "\r\n")
+	*fileTarget = file
+	return nil
+}
+
+// secretFile writes a secret for managed containers and returns its path inside them
+func (c *Config) secretFile(name, value string) (string, error) {
+	file := path.Join(c.ConfigPath, secretsDir, name)
+	existing, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err != nil || !bytes.Equal(existing, []byte(value)) {
+		if err := writeFileAtomic(file, []byte(value), 0600); err != nil {
+			return "", err
+		}
+	}
+	return path.Join(docker.ConfigDirDest, secretsDir, name), nil
+}
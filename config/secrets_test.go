@@ -0,0 +1,51 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "password"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CATTLE_DB_CATTLE_PASSWORD_FILE", "password")
+	defer os.Unsetenv("CATTLE_DB_CATTLE_PASSWORD_FILE")
+
+	c := &Config{ConfigPath: dir, DBPassword: "cattle", DBHost: "mysql", DBPort: 3306}
+	if err := (settings{}).setSecret(&c.DBPassword, &c.DBPasswordFile, "CATTLE_DB_CATTLE_PASSWORD", dir); err != nil {
+		t.Fatal(err)
+	}
+	if c.DBPassword != "s3cret" || c.DBPasswordFile != path.Join(dir, "password") {
+		t.Fatalf("Expected the password to be read from the file, got %s", c.DBPassword)
+	}
+
+	env, err := c.DBEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env["CATTLE_DB_CATTLE_PASSWORD"]; ok {
+		t.Fatalf("Expected no password in the container environment, got %v", env)
+	}
+	if env["CATTLE_DB_CATTLE_PASSWORD_FILE"] != "/var/lib/rancher/etc/cluster/secrets/db-password" {
+		t.Fatalf("Unexpected password file %s", env["CATTLE_DB_CATTLE_PASSWORD_FILE"])
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, secretsDir, "db-password"))
+	if err != nil || string(content) != "s3cret" {
+		t.Fatalf("Expected the password to be written for cattle, got %q %v", content, err)
+	}
+
+	os.Setenv("CATTLE_DB_CATTLE_PASSWORD_FILE", "missing")
+	if err := (settings{}).setSecret(&c.DBPassword, &c.DBPasswordFile, "CATTLE_DB_CATTLE_PASSWORD", dir); err == nil {
+		t.Fatal("Expected a missing password file to be reported")
+	}
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rancher/cluster-manager/db"
+	"github.com/rancher/cluster-manager/docker"
+)
+
+const (
+	DBTLSDisabled   = "disabled"
+	DBTLSRequired   = "required"
+	DBTLSVerifyCA   = "verify-ca"
+	DBTLSVerifyFull = "verify-full"
+
+	mysqlTLSConfigName = "cluster-manager"
+)
+
+func (c *Config) dbTLSEnabled() bool {
+	return c.DBTLSMode != "" && c.DBTLSMode != DBTLSDisabled
+}
+
+func (c *Config) dbTLSFile(file string) string {
+	if file == "" {
+		return ""
+	}
+	return path.Join(c.ConfigPath, file)
+}
+
+// dbTLSConfig builds the client TLS settings for the membership database, nil when TLS is disabled
+func (c *Config) dbTLSConfig(host string) (*tls.Config, error) {
+	if !c.dbTLSEnabled() {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: c.DBTLSServerName,
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if c.DBTLSCertPath != "" || c.DBTLSKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.dbTLSFile(c.DBTLSCertPath), c.dbTLSFile(c.DBTLSKeyPath))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load database client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.DBTLSCAPath != "" {
+		pem, err := ioutil.ReadFile(c.dbTLSFile(c.DBTLSCAPath))
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in database CA %s", c.dbTLSFile(c.DBTLSCAPath))
+		}
+	}
+
+	switch c.DBTLSMode {
+	case DBTLSRequired:
+		config.InsecureSkipVerify = true
+	case DBTLSVerifyCA:
+		// Check the chain ourselves since the standard verification also insists on the host name
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(config.RootCAs)
+	case DBTLSVerifyFull:
+	default:
+		return nil, fmt.Errorf("CATTLE_HA_DB_TLS_MODE must be one of %s, %s, %s or %s, got %s",
+			DBTLSDisabled, DBTLSRequired, DBTLSVerifyCA, DBTLSVerifyFull, c.DBTLSMode)
+	}
+
+	return config, nil
+}
+
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Database server presented no certificate")
+		}
+
+		certs := []*x509.Certificate{}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+func (c *Config) mysqlTLS(host string) (string, error) {
+	config, err := c.dbTLSConfig(host)
+	if err != nil || config == nil {
+		return "", err
+	}
+
+	// One registration per endpoint so each is verified against its own host name
+	name := mysqlTLSConfigName + "-" + host
+	if err := mysql.RegisterTLSConfig(name, config); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *Config) postgresTLS(host string) (url.Values, error) {
+	if !c.dbTLSEnabled() {
+		return url.Values{"sslmode": {"disable"}}, nil
+	}
+
+	// Validates the mode and files even though lib/pq loads them itself
+	if _, err := c.dbTLSConfig(host); err != nil {
+		return nil, err
+	}
+
+	mode := c.DBTLSMode
+	if mode == DBTLSRequired {
+		mode = "require"
+	}
+
+	params := url.Values{"sslmode": {mode}}
+	for key, file := range map[string]string{
+		"sslrootcert": c.DBTLSCAPath,
+		"sslcert":     c.DBTLSCertPath,
+		"sslkey":      c.DBTLSKeyPath,
+	} {
+		if file != "" {
+			params.Set(key, c.dbTLSFile(file))
+		}
+	}
+	return params, nil
+}
+
+// cattleTLSEnv points cattle at the same TLS settings through its JDBC URL. The files are read from the config
+// directory, which is mounted into every managed container.
+func (c *Config) cattleTLSEnv(host string, port int) (map[string]string, error) {
+	if !c.dbTLSEnabled() {
+		return map[string]string{}, nil
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if c.DBType == db.Postgres {
+		params, err := c.cattlePostgresTLS()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{
+			"CATTLE_DB_CATTLE_POSTGRES_URL": fmt.Sprintf("jdbc:postgresql://%s/%s?%s", addr, c.DBName, params.Encode()),
+		}, nil
+	}
+
+	// Connector/J only reads Java keystores, and never checks the host name. Validate refuses keystore passwords,
+	// they could only be passed in this URL, which ends up in cattle's environment.
+	verify := c.DBTLSMode == DBTLSVerifyCA || c.DBTLSMode == DBTLSVerifyFull
+	params := url.Values{
+		"useUnicode":              {"true"},
+		"characterEncoding":       {"UTF-8"},
+		"useSSL":                  {"true"},
+		"requireSSL":              {"true"},
+		"verifyServerCertificate": {strconv.FormatBool(verify)},
+	}
+	if c.DBTLSTrustStorePath != "" {
+		params.Set("trustCertificateKeyStoreUrl", "file:"+path.Join(docker.ConfigDirDest, c.DBTLSTrustStorePath))
+	}
+	if c.DBTLSKeyStorePath != "" {
+		params.Set("clientCertificateKeyStoreUrl", "file:"+path.Join(docker.ConfigDirDest, c.DBTLSKeyStorePath))
+	}
+
+	return map[string]string{
+		"CATTLE_DB_CATTLE_MYSQL_URL": fmt.Sprintf("jdbc:mysql://%s/%s?%s", addr, c.DBName, params.Encode()),
+	}, nil
+}
+
+// cattlePostgresTLS builds the Postgres JDBC driver parameters. The driver takes the same PEM certificates,
+// but wants the client key as PKCS#8 DER.
+func (c *Config) cattlePostgresTLS() (url.Values, error) {
+	mode := c.DBTLSMode
+	if mode == DBTLSRequired {
+		mode = "require"
+	}
+
+	params := url.Values{"ssl": {"true"}, "sslmode": {mode}}
+	if c.DBTLSCAPath != "" {
+		params.Set("sslrootcert", path.Join(docker.ConfigDirDest, c.DBTLSCAPath))
+	}
+	if c.DBTLSCertPath != "" {
+		params.Set("sslcert", path.Join(docker.ConfigDirDest, c.DBTLSCertPath))
+	}
+	if c.DBTLSKeyPath != "" {
+		key, err := pkcs8Key(c.dbTLSFile(c.DBTLSKeyPath))
+		if err != nil {
+			return nil, err
+		}
+		file, err := c.secretFile("db-tls-key.pk8", string(key))
+		if err != nil {
+			return nil, err
+		}
+		params.Set("sslkey", file)
+	}
+	return params, nil
+}
+
+func pkcs8Key(file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM key found in %s", file)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return block.Bytes, nil
+	}
+
+	var key interface{}
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Unsupported database client key %s: %v", file, err)
+		}
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
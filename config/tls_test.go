@@ -0,0 +1,154 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/cluster-manager/db"
+)
+
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestDBTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, "ca", nil, nil)
+	server, _ := newCert(t, "mysql.internal", ca, caKey)
+	other, _ := newCert(t, "other", nil, nil)
+
+	err = ioutil.WriteFile(path.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		ConfigPath:  dir,
+		DBHost:      "10.0.0.5",
+		DBPort:      3306,
+		DBName:      "cattle",
+		DBTLSMode:   DBTLSVerifyCA,
+		DBTLSCAPath: "ca.pem",
+	}
+
+	config, err := c.dbTLSConfig(c.DBHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.VerifyPeerCertificate([][]byte{server.Raw}, nil); err != nil {
+		t.Fatalf("Expected verify-ca to accept a certificate for another host name, got %v", err)
+	}
+	if err := config.VerifyPeerCertificate([][]byte{other.Raw}, nil); err == nil {
+		t.Fatal("Expected verify-ca to reject a certificate from another CA")
+	}
+
+	c.DBTLSMode = DBTLSVerifyFull
+	if config, err = c.dbTLSConfig(c.DBHost); err != nil {
+		t.Fatal(err)
+	}
+	if config.InsecureSkipVerify || config.ServerName != "10.0.0.5" {
+		t.Fatalf("Expected verify-full to check the host name, got %#v", config)
+	}
+
+	c.DBTLSTrustStorePath, c.DBTLSKeyStorePath = "truststore.p12", "keystore.p12"
+	env, err := c.DBEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := jdbcParams(t, env["CATTLE_DB_CATTLE_MYSQL_URL"])
+	if params.Get("verifyServerCertificate") != "true" || params.Get("trustCertificateKeyStoreUrl") != "file:/var/lib/rancher/etc/truststore.p12" ||
+		params.Get("clientCertificateKeyStoreUrl") != "file:/var/lib/rancher/etc/keystore.p12" {
+		t.Fatalf("Expected TLS settings in the cattle JDBC URL, got %v", env)
+	}
+	if strings.Contains(env["CATTLE_DB_CATTLE_MYSQL_URL"], "Password") {
+		t.Fatalf("Expected no keystore password in the cattle JDBC URL, got %v", env)
+	}
+
+	der, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DBType = db.Postgres
+	c.DBTLSCertPath, c.DBTLSKeyPath = "cert.pem", "key.pem"
+	if env, err = c.DBEnv(); err != nil {
+		t.Fatal(err)
+	}
+	params = jdbcParams(t, env["CATTLE_DB_CATTLE_POSTGRES_URL"])
+	if params.Get("sslmode") != DBTLSVerifyFull || params.Get("sslrootcert") != "/var/lib/rancher/etc/ca.pem" ||
+		params.Get("sslcert") != "/var/lib/rancher/etc/cert.pem" {
+		t.Fatalf("Expected TLS settings in the cattle JDBC URL, got %v", env)
+	}
+	key, err := ioutil.ReadFile(path.Join(dir, secretsDir, path.Base(params.Get("sslkey"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(key); err != nil {
+		t.Fatalf("Expected the client key to be converted to PKCS#8: %v", err)
+	}
+
+	c.DBTLSMode = "sometimes"
+	if _, err := c.dbTLSConfig(c.DBHost); err == nil {
+		t.Fatal("Expected an unknown TLS mode to be refused")
+	}
+}
+
+func jdbcParams(t *testing.T, jdbcURL string) url.Values {
+	parts := strings.SplitN(jdbcURL, "?", 2)
+	if len(parts) != 2 {
+		t.Fatalf("Expected parameters in JDBC URL %s", jdbcURL)
+	}
+	params, err := url.ParseQuery(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/cluster-manager/db"
+	"github.com/rancher/cluster-manager/docker"
+)
+
+const tunnelPortOffset = 10000
+
+// Problem is a single invalid setting and the environment variable that controls it
+type Problem struct {
+	Env     string
+	Message string
+}
+
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{"Invalid configuration:"}
+	for _, p := range e.Problems {
+		lines = append(lines, fmt.Sprintf("  %s: %s", p.Env, p.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationError) add(env, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{Env: env, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate reports every invalid setting at once, before any container is launched
+func (c *Config) Validate() error {
+	e := &ValidationError{}
+
+	if c.ClusterSize < 1 || c.ClusterSize%2 == 0 {
+		e.add("CATTLE_HA_CLUSTER_SIZE", "must be an odd number so zookeeper can keep a quorum, got %d", c.ClusterSize)
+	}
+	if c.ClusterIP == "" {
+		e.add("CATTLE_HA_CLUSTER_IP", "must be set")
+	} else if net.ParseIP(c.ClusterIP) == nil {
+		e.add("CATTLE_HA_CLUSTER_IP", "must be an IP address, got %s", c.ClusterIP)
+	}
+	if c.ClusterID == "" {
+		e.add("CATTLE_HA_CLUSTER_ID", "must not be empty")
+	}
+	if c.HeartbeatInterval <= 0 {
+		e.add("CATTLE_HA_HEARTBEAT_INTERVAL", "must be positive, got %v", c.HeartbeatInterval)
+	}
+	if c.HeartbeatMissed < 1 {
+		e.add("CATTLE_HA_HEARTBEAT_MISSED", "must be at least 1, got %d", c.HeartbeatMissed)
+	}
+	if c.LeaveGrace < 0 {
+		e.add("CATTLE_HA_LEAVE_GRACE", "must not be negative, got %v", c.LeaveGrace)
+	}
+	if c.StatusPort < 0 || c.StatusPort > 65535 {
+		e.add("CATTLE_HA_STATUS_PORT", "must be between 0 and 65535, got %d", c.StatusPort)
+	}
+
+	if c.HostRegistrationURL != "" {
+		u, err := url.Parse(c.HostRegistrationURL)
+		switch {
+		case err != nil:
+			e.add("CATTLE_HA_HOST_REGISTRATION_URL", "%v", err)
+		case u.Scheme != "http" && u.Scheme != "https":
+			e.add("CATTLE_HA_HOST_REGISTRATION_URL", "must start with http:// or https://, got %s", c.HostRegistrationURL)
+		case u.Host == "":
+			e.add("CATTLE_HA_HOST_REGISTRATION_URL", "must include a host, got %s", c.HostRegistrationURL)
+		}
+	}
+
+	c.validateDB(e)
+	c.validatePorts(e)
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (c *Config) validateDB(e *ValidationError) {
+	portEnv := "CATTLE_DB_CATTLE_MYSQL_PORT"
+	switch c.DBType {
+	case db.MySQL:
+	case db.Postgres:
+		portEnv = "CATTLE_DB_CATTLE_POSTGRES_PORT"
+	default:
+		e.add("CATTLE_DB_CATTLE_DATABASE", "must be %s or %s, got %s", db.MySQL, db.Postgres, c.DBType)
+	}
+
+	if c.DBPort < 1 || c.DBPort > 65535 {
+		e.add(portEnv, "must be between 1 and 65535, got %d", c.DBPort)
+	}
+	if c.DBTimeout <= 0 {
+		e.add("CATTLE_HA_DB_TIMEOUT", "must be positive, got %v", c.DBTimeout)
+	}
+	if c.DBStartupTimeout <= 0 {
+		e.add("CATTLE_HA_DB_STARTUP_TIMEOUT", "must be positive, got %v", c.DBStartupTimeout)
+	}
+	if c.DBRetryMaxInterval <= 0 {
+		e.add("CATTLE_HA_DB_RETRY_MAX_INTERVAL", "must be positive, got %v", c.DBRetryMaxInterval)
+	}
+	if _, err := c.DBEndpoints(); err != nil {
+		e.add("CATTLE_HA_DB_HOSTS", "%v", err)
+	}
+
+	switch c.DBTLSMode {
+	case "", DBTLSDisabled, DBTLSRequired, DBTLSVerifyCA, DBTLSVerifyFull:
+	default:
+		e.add("CATTLE_HA_DB_TLS_MODE", "must be one of %s, %s, %s or %s, got %s",
+			DBTLSDisabled, DBTLSRequired, DBTLSVerifyCA, DBTLSVerifyFull, c.DBTLSMode)
+	}
+	if (c.DBTLSCertPath == "") != (c.DBTLSKeyPath == "") {
+		e.add("CATTLE_HA_DB_TLS_KEY_PATH", "must be set together with CATTLE_HA_DB_TLS_CERT_PATH")
+	}
+
+	// Connector/J ignores the PEM files, without keystores cattle would connect with weaker settings than the manager
+	if c.DBType == db.MySQL && c.dbTLSEnabled() {
+		if (c.DBTLSMode == DBTLSVerifyCA || c.DBTLSMode == DBTLSVerifyFull) && c.DBTLSTrustStorePath == "" {
+			e.add("CATTLE_HA_DB_TLS_TRUSTSTORE_PATH", "must be set for %s so cattle verifies the database server", c.DBTLSMode)
+		}
+		if (c.DBTLSCertPath != "" || c.DBTLSKeyPath != "") && c.DBTLSKeyStorePath == "" {
+			e.add("CATTLE_HA_DB_TLS_KEYSTORE_PATH", "must be set with CATTLE_HA_DB_TLS_CERT_PATH so cattle presents the client certificate")
+		}
+	}
+	if c.DBType == db.MySQL && c.DBTLSKeyStorePassword != "" {
+		e.add("CATTLE_HA_DB_TLS_KEYSTORE_PASSWORD", "is not supported, cattle could only get it in its environment, use keystores without a password")
+	}
+}
+
+func portEnv(service string) string {
+	return "CATTLE_HA_PORT_" + strings.ToUpper(strings.Replace(service, "-", "_", -1))
+}
+
+// validatePorts checks the published service ports against each other, the fixed parent bindings
+// and the ports the tunnels listen on
+func (c *Config) validatePorts(e *ValidationError) {
+	for _, service := range sortedServices(c.Ports) {
+		if _, ok := db.DefaultServicePorts[service]; !ok {
+			e.add(portEnv(service), "is not a known service port")
+		}
+	}
+
+	tunneled := map[string]bool{}
+	tunnelPorts := map[int]string{}
+	for _, service := range db.ServicePorts {
+		tunneled[service] = true
+		tunnelPorts[db.DefaultServicePorts[service]+tunnelPortOffset] = service
+	}
+
+	parentPorts := map[int]bool{}
+	for _, binding := range docker.Parent.Ports {
+		if port, err := strconv.Atoi(strings.SplitN(binding, ":", 2)[0]); err == nil {
+			parentPorts[port] = true
+		}
+	}
+
+	used := map[int]string{}
+	for _, service := range sortedServices(db.DefaultServicePorts) {
+		port := db.LookupPortByService(c.Ports, service)
+		env := portEnv(service)
+
+		switch {
+		case port < 1 || port > 65535:
+			e.add(env, "must be between 1 and 65535, got %d", port)
+			continue
+		case used[port] != "":
+			e.add(env, "port %d is also used by %s", port, portEnv(used[port]))
+		case tunnelPorts[port] != "":
+			e.add(env, "port %d is used by the %s tunnel", port, tunnelPorts[port])
+		case parentPorts[port] && !(tunneled[service] && port == db.DefaultServicePorts[service]):
+			e.add(env, "port %d is already bound by the parent container", port)
+		}
+		used[port] = service
+	}
+}
+
+func sortedServices(ports map[string]int) []string {
+	result := []string{}
+	for service := range ports {
+		result = append(result, service)
+	}
+	sort.Strings(result)
+	return result
+}
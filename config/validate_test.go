@@ -0,0 +1,123 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/cluster-manager/db"
+)
+
+func validConfig() *Config {
+	return &Config{
+		ClusterID:          db.DefaultCluster,
+		ClusterIP:          "10.0.0.1",
+		ClusterSize:        3,
+		HeartbeatInterval:  5 * time.Second,
+		HeartbeatMissed:    2,
+		DBType:             db.MySQL,
+		DBHost:             "mysql",
+		DBPort:             3306,
+		DBTimeout:          10 * time.Second,
+		DBStartupTimeout:   5 * time.Minute,
+		DBRetryMaxInterval: 30 * time.Second,
+		Ports:              map[string]int{},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := validConfig()
+	c.ClusterSize = 2
+	c.ClusterIP = "node1"
+	c.HostRegistrationURL = "rancher.example.com"
+	c.Ports = map[string]int{db.HTTP: 8080, db.HTTPS: 8080, db.Redis: 12181, db.Swarm: 18080, "bogus": 1}
+	c.DBTimeout = 0
+	c.DBRetryMaxInterval = -time.Second
+
+	err, ok := c.Validate().(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+
+	expected := map[string]bool{
+		"CATTLE_HA_CLUSTER_SIZE":          true,
+		"CATTLE_HA_CLUSTER_IP":            true,
+		"CATTLE_HA_HOST_REGISTRATION_URL": true,
+		"CATTLE_HA_PORT_HTTPS":            true,
+		"CATTLE_HA_PORT_REDIS":            true,
+		"CATTLE_HA_PORT_SWARM":            true,
+		"CATTLE_HA_PORT_BOGUS":            true,
+		"CATTLE_HA_DB_TIMEOUT":            true,
+		"CATTLE_HA_DB_RETRY_MAX_INTERVAL": true,
+	}
+	for _, p := range err.Problems {
+		if !expected[p.Env] {
+			t.Errorf("Unexpected problem %s: %s", p.Env, p.Message)
+		}
+		delete(expected, p.Env)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("Missing problems for %v in %v", expected, err)
+	}
+}
+
+func TestValidateMySQLTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(c *Config)
+		problem string
+	}{
+		{"verify without truststore", func(c *Config) {
+			c.DBTLSMode = DBTLSVerifyCA
+			c.DBTLSCAPath = "ca.pem"
+		}, "CATTLE_HA_DB_TLS_TRUSTSTORE_PATH"},
+		{"verify with truststore", func(c *Config) {
+			c.DBTLSMode = DBTLSVerifyFull
+			c.DBTLSCAPath = "ca.pem"
+			c.DBTLSTrustStorePath = "truststore.p12"
+		}, ""},
+		{"client certificate without keystore", func(c *Config) {
+			c.DBTLSMode = DBTLSRequired
+			c.DBTLSCertPath = "cert.pem"
+			c.DBTLSKeyPath = "key.pem"
+		}, "CATTLE_HA_DB_TLS_KEYSTORE_PATH"},
+		{"client certificate with keystore", func(c *Config) {
+			c.DBTLSMode = DBTLSRequired
+			c.DBTLSCertPath = "cert.pem"
+			c.DBTLSKeyPath = "key.pem"
+			c.DBTLSKeyStorePath = "keystore.p12"
+		}, ""},
+		{"keystore password", func(c *Config) {
+			c.DBTLSMode = DBTLSRequired
+			c.DBTLSTrustStorePath = "truststore.p12"
+			c.DBTLSKeyStorePassword = "changeit"
+		}, "CATTLE_HA_DB_TLS_KEYSTORE_PASSWORD"},
+		{"postgres reads the PEM files", func(c *Config) {
+			c.DBType = db.Postgres
+			c.DBTLSMode = DBTLSVerifyFull
+			c.DBTLSCAPath = "ca.pem"
+			c.DBTLSCertPath = "cert.pem"
+			c.DBTLSKeyPath = "key.pem"
+		}, ""},
+	}
+
+	for _, test := range tests {
+		c := validConfig()
+		test.update(c)
+		err := c.Validate()
+		if test.problem == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(*ValidationError)
+		if !ok || len(verr.Problems) != 1 || verr.Problems[0].Env != test.problem {
+			t.Errorf("%s: expected a single problem for %s, got %v", test.name, test.problem, err)
+		}
+	}
+}
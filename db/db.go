@@ -4,6 +4,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"fmt"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -25,6 +30,12 @@ const (
 	ZkPortBase2       = 3888
 	ZkPortBaseClient  = 2181
 	RancherServerPort = 18080
+
+	desiredSizeSetting = "cluster.size"
+	// resizeStepSetting names the one member the master currently lets switch to the desired size
+	resizeStepSetting = "cluster.size.step"
+
+	DefaultCluster = "default"
 )
 
 var (
@@ -51,7 +62,14 @@ type Member struct {
 	Ports          map[string]int
 	RequestedIndex int
 	Heartbeat      int
+	HeartbeatAge   time.Duration
 	Index          int
+	Draining       bool
+	// Leaving is set when the member shut down, it keeps its row and index if it comes back in time
+	Leaving bool
+	KeyID   string
+	// ClusterSize is the size the member currently runs zookeeper and redis with
+	ClusterSize int
 }
 
 func LookupPortByService(ports map[string]int, service string) int {
@@ -62,46 +80,75 @@ func LookupPortByService(ports map[string]int, service string) int {
 }
 
 type DB struct {
-	db *sql.DB
+	sync.RWMutex
+	db        *sql.DB
+	driver    string
+	dialect   dialect
+	cluster   string
+	endpoints []Endpoint
+	active    int
+	pool      pool
+	// retired is the pool replaced by the last failover. It is closed on the next ping so callers that
+	// already took it from conn() can finish.
+	retired *sql.DB
+}
+
+type pool struct {
+	maxOpen     int
+	maxIdle     int
+	maxLifetime time.Duration
 }
 
-func New(driverName, dsn string) (*DB, error) {
-	db, err := sql.Open(driverName, dsn)
+func New(driverName string, endpoints []Endpoint, cluster string) (*DB, error) {
+	dialect, ok := dialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported database %s, expected %s or %s", driverName, MySQL, Postgres)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("No database endpoints given")
+	}
+
+	db, err := sql.Open(driverName, endpoints[0].DSN)
 	return &DB{
-		db: db,
+		db:        db,
+		driver:    driverName,
+		dialect:   dialect,
+		cluster:   cluster,
+		endpoints: endpoints,
+		pool:      pool{maxIdle: 2},
 	}, err
 }
 
+func (d *DB) ConfigurePool(maxOpen, maxIdle int, maxLifetime time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.pool = pool{maxOpen, maxIdle, maxLifetime}
+	d.pool.apply(d.db)
+}
+
+func (p pool) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.maxOpen)
+	db.SetMaxIdleConns(p.maxIdle)
+	db.SetConnMaxLifetime(p.maxLifetime)
+}
+
+func (d *DB) conn() *sql.DB {
+	d.RLock()
+	defer d.RUnlock()
+	return d.db
+}
+
 type Members []Member
 
 func (a Members) Len() int           { return len(a) }
 func (a Members) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Members) Less(i, j int) bool { return a[i].ID < a[j].ID }
 
-func (d *DB) Migrate() error {
-	_, err := d.Members()
-	if err == nil {
-		return nil
-	}
-
-	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS `cluster` (" +
-		"`id` bigint(20) NOT NULL AUTO_INCREMENT," +
-		"`name` varchar(256) DEFAULT NULL," +
-		"`heartbeat` bigint(20) DEFAULT 0 NOT NULL," +
-		"`uuid` varchar(128) NOT NULL," +
-		"`ip_address` varchar(128) NOT NULL," +
-		"`requested_index` int(11) NOT NULL," +
-		"`assigned_index` int(11) DEFAULT 0 NOT NULL," +
-		"`ports` varchar(1024)," +
-		" PRIMARY KEY (id)" +
-		") ENGINE=InnoDB DEFAULT CHARSET=utf8;")
-	return err
-}
-
 func (d *DB) Members() ([]Member, error) {
-	rows, err := d.db.Query(`SELECT 
-			id, name, heartbeat, uuid, assigned_index, requested_index, ports, ip_address
-		FROM cluster ORDER BY id ASC`)
+	rows, err := d.conn().Query(d.q(`SELECT
+			id, name, heartbeat, COALESCE(`+d.dialect.since("last_seen")+`, 0), uuid, COALESCE(assigned_index, 0), requested_index, ports, ip_address, draining, leaving, key_id, cluster_size
+		FROM cluster WHERE cluster_id = ? ORDER BY id ASC`), d.cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -111,14 +158,15 @@ func (d *DB) Members() ([]Member, error) {
 
 	for rows.Next() {
 		ports := ""
+		age := int64(0)
 		member := Member{}
-		if err := rows.Scan(&member.ID, &NullStringWrapper{String: &member.Name}, &member.Heartbeat, &member.UUID, &member.Index, &member.RequestedIndex, &NullStringWrapper{String: &ports},
-			&member.IP); err != nil {
+		if err := rows.Scan(&member.ID, &NullStringWrapper{String: &member.Name}, &member.Heartbeat, &age, &member.UUID, &member.Index, &member.RequestedIndex, &NullStringWrapper{String: &ports},
+			&member.IP, &member.Draining, &member.Leaving, &NullStringWrapper{String: &member.KeyID}, &member.ClusterSize); err != nil {
 			return nil, err
 		}
+		member.HeartbeatAge = time.Duration(age) * time.Second
 		if ports != "" {
-			member := map[string]int{}
-			if err := json.Unmarshal([]byte(ports), member); err != nil {
+			if err := json.Unmarshal([]byte(ports), &member.Ports); err != nil {
 				return nil, err
 			}
 		}
@@ -144,13 +192,13 @@ func (d *DB) APIKeys() (string, string, error) {
 	}
 }
 func (d *DB) apiKeys() (string, string, error) {
-	rows, err := d.db.Query(`SELECT public_value, secret_value FROM credential c
+	rows, err := d.conn().Query(d.q(`SELECT public_value, secret_value FROM credential c
 		JOIN account a
 		  ON (c.account_id = a.id)
 		WHERE
 		  c.state = ?
 		  AND a.state = ?
-		  AND a.uuid = ?`, "active", "active", "machineServiceAccount")
+		  AND a.uuid = ?`), "active", "active", "machineServiceAccount")
 	if err != nil {
 		return "", "", err
 	}
@@ -168,40 +216,311 @@ func (d *DB) apiKeys() (string, string, error) {
 }
 
 func (d *DB) Delete(uuid string) error {
-	_, err := d.execCount(`DELETE FROM cluster WHERE uuid = ?`, uuid)
+	_, err := d.execCount(`DELETE FROM cluster WHERE cluster_id = ? AND uuid = ?`, d.cluster, uuid)
+	return err
+}
+
+func (d *DB) SetDraining(uuid string, draining bool) error {
+	count, err := d.execCount(`UPDATE cluster SET draining = ? WHERE cluster_id = ? AND uuid = ?`, draining, d.cluster, uuid)
+	if err == nil && count == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *DB) Leave(uuid string) error {
+	count, err := d.execCount(`UPDATE cluster SET leaving = ? WHERE cluster_id = ? AND uuid = ?`, true, d.cluster, uuid)
+	if err == nil && count == 0 {
+		return ErrNotFound
+	}
 	return err
 }
 
+func (d *DB) Evict(term int64, uuid string) error {
+	return d.inTx(func(tx *sql.Tx) error {
+		lease, valid, err := d.selectLease(tx)
+		if err != nil {
+			return err
+		}
+		if !valid || lease.Term != term {
+			return ErrStaleTerm
+		}
+
+		_, err = tx.Exec(d.q(`DELETE FROM cluster WHERE cluster_id = ? AND uuid = ?`), d.cluster, uuid)
+		return err
+	})
+}
+
 func (d *DB) Checkin(member Member, i int) error {
-	count, err := d.execCount(`UPDATE cluster SET heartbeat = ? WHERE uuid = ?`, i, member.UUID)
+	ports, err := json.Marshal(member.Ports)
+	if err != nil {
+		return err
+	}
+
+	count, err := d.execCount(`UPDATE cluster SET heartbeat = ?, name = ?, ip_address = ?, ports = ?, key_id = ?, cluster_size = ?,
+		leaving = ?, last_seen = NOW() WHERE cluster_id = ? AND uuid = ?`,
+		i, member.Name, member.IP, string(ports), member.KeyID, member.ClusterSize, false, d.cluster, member.UUID)
 	if err != nil {
 		return err
 	}
 
 	if count == 0 {
-		_, err := d.execCount(`INSERT INTO cluster(name,uuid,ip_address,requested_index) values(?, ?, ?, ?)`,
-			member.Name, member.UUID, member.IP, member.RequestedIndex)
+		_, err := d.execCount(`INSERT INTO cluster(cluster_id,name,uuid,ip_address,requested_index,ports,key_id,cluster_size,last_seen)
+			values(?, ?, ?, ?, ?, ?, ?, ?, NOW())`,
+			d.cluster, member.Name, member.UUID, member.IP, member.RequestedIndex, string(ports), member.KeyID, member.ClusterSize)
 		if err != nil {
 			return err
 		}
+
+		return d.RecordEvent(Event{
+			Actor:  member.UUID,
+			Event:  EventJoin,
+			Target: member.UUID,
+			Reason: "Checked in as " + member.IP,
+		})
 	}
 
 	return nil
 }
 
-func (d *DB) SaveIndex(indexes map[int]Member) error {
-	for index, member := range indexes {
-		_, err := d.execCount(`UPDATE cluster SET  assigned_index = ?, requested_index = ? WHERE ID = ?`,
-			index, 0, member.ID)
+func (d *DB) RecordEvent(event Event) error {
+	_, err := d.execCount(`INSERT INTO cluster_event(cluster_id, created, actor, event, target, reason) values(?, NOW(), ?, ?, ?, ?)`,
+		d.cluster, event.Actor, event.Event, event.Target, event.Reason)
+	return err
+}
+
+func (d *DB) Events(limit int) ([]Event, error) {
+	rows, err := d.conn().Query(d.q(`SELECT id, `+d.dialect.epoch("created")+`, actor, event, target, reason
+		FROM cluster_event WHERE cluster_id = ? ORDER BY id DESC LIMIT ?`), d.cluster, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []Event{}
+	for rows.Next() {
+		created := int64(0)
+		target := sql.NullString{}
+		reason := sql.NullString{}
+		event := Event{}
+		if err := rows.Scan(&event.ID, &created, &event.Actor, &event.Event, &target, &reason); err != nil {
+			return nil, err
+		}
+		event.Created = time.Unix(created, 0)
+		event.Target = target.String
+		event.Reason = reason.String
+		result = append(result, event)
+	}
+
+	return result, rows.Err()
+}
+
+func (d *DB) AcquireLease(uuid string, ttl time.Duration) (Lease, error) {
+	lease := Lease{}
+	err := d.inTx(func(tx *sql.Tx) error {
+		current, valid, err := d.selectLease(tx)
 		if err != nil {
 			return err
 		}
+
+		lease = current
+		seconds := int64(ttl / time.Second)
+		if !valid {
+			excluded := 0
+			err := tx.QueryRow(d.q(`SELECT COUNT(*) FROM cluster_lease WHERE cluster_id = ? AND excluded = ? AND excluded_until > NOW()`),
+				d.cluster, uuid).
+				Scan(&excluded)
+			if err != nil || excluded > 0 {
+				lease.Holder = ""
+				return err
+			}
+		}
+
+		if lease.Holder == uuid && valid {
+			_, err = tx.Exec(d.q(`UPDATE cluster_lease SET expires = `+d.dialect.fromNow()+` WHERE cluster_id = ?`),
+				seconds, d.cluster)
+		} else if !valid {
+			lease.Holder = uuid
+			lease.Term++
+			_, err = tx.Exec(d.q(`UPDATE cluster_lease SET holder = ?, term = ?, expires = `+d.dialect.fromNow()+` WHERE cluster_id = ?`),
+				lease.Holder, lease.Term, seconds, d.cluster)
+		}
+		return err
+	})
+	return lease, err
+}
+
+func (d *DB) Lease() (Lease, error) {
+	lease := Lease{}
+	err := d.inTx(func(tx *sql.Tx) error {
+		current, valid, err := d.selectLease(tx)
+		if valid {
+			lease = current
+		}
+		return err
+	})
+	return lease, err
+}
+
+func (d *DB) StepDown(hold time.Duration) (Lease, error) {
+	lease := Lease{}
+	err := d.inTx(func(tx *sql.Tx) error {
+		current, valid, err := d.selectLease(tx)
+		if err != nil || !valid {
+			return err
+		}
+
+		lease = current
+		_, err = tx.Exec(d.q(`UPDATE cluster_lease SET expires = NOW(), excluded = holder, excluded_until = `+d.dialect.fromNow()+`
+			WHERE cluster_id = ?`), int64(hold/time.Second), d.cluster)
+		return err
+	})
+	return lease, err
+}
+
+func (d *DB) ReleaseLease(uuid string) error {
+	_, err := d.execCount(`UPDATE cluster_lease SET expires = NOW() WHERE cluster_id = ? AND holder = ?`, d.cluster, uuid)
+	return err
+}
+
+func (d *DB) CheckLease(uuid string, term int64) error {
+	return d.inTx(func(tx *sql.Tx) error {
+		lease, valid, err := d.selectLease(tx)
+		if err != nil {
+			return err
+		}
+		if !valid || lease.Holder != uuid || lease.Term != term {
+			return ErrStaleTerm
+		}
+		return nil
+	})
+}
+
+func (d *DB) SaveIndex(term int64, release []Member, assign map[int]Member) error {
+	err := d.inTx(func(tx *sql.Tx) error {
+		lease, valid, err := d.selectLease(tx)
+		if err != nil {
+			return err
+		}
+		if !valid || lease.Term != term {
+			return ErrStaleTerm
+		}
+
+		current, err := d.selectIndexes(tx)
+		if err != nil {
+			return err
+		}
+
+		changes, err := planIndexes(current, release, assign)
+		if err != nil {
+			return err
+		}
+
+		// Clear every changed row first so moving an index between members never trips the unique key
+		for id := range changes {
+			_, err := tx.Exec(d.q(`UPDATE cluster SET assigned_index = NULL WHERE cluster_id = ? AND ID = ?`), d.cluster, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		for id, index := range changes {
+			if index <= 0 {
+				continue
+			}
+			_, err := tx.Exec(d.q(`UPDATE cluster SET assigned_index = ?, requested_index = 0 WHERE cluster_id = ? AND ID = ?`),
+				index, d.cluster, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if isDuplicateKey(err) {
+		return ErrIndexConflict
 	}
-	return nil
+	return err
+}
+
+func (d *DB) selectIndexes(tx *sql.Tx) (map[int]int, error) {
+	rows, err := tx.Query(d.q(`SELECT id, COALESCE(assigned_index, 0) FROM cluster WHERE cluster_id = ? FOR UPDATE`), d.cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int]int{}
+	for rows.Next() {
+		id, index := 0, 0
+		if err := rows.Scan(&id, &index); err != nil {
+			return nil, err
+		}
+		result[id] = index
+	}
+
+	return result, rows.Err()
+}
+
+func (d *DB) DesiredSize() (int, error) {
+	value := ""
+	err := d.conn().QueryRow(d.q(`SELECT value FROM cluster_setting WHERE cluster_id = ? AND name = ?`), d.cluster, desiredSizeSetting).
+		Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(value)
+}
+
+func (d *DB) SetDesiredSize(size int) error {
+	_, err := d.execCount(d.dialect.setSetting, d.cluster, desiredSizeSetting, strconv.Itoa(size))
+	return err
+}
+
+func (d *DB) ResizeStep() (string, error) {
+	value := ""
+	err := d.conn().QueryRow(d.q(`SELECT value FROM cluster_setting WHERE cluster_id = ? AND name = ?`), d.cluster, resizeStepSetting).
+		Scan(&NullStringWrapper{String: &value})
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (d *DB) SetResizeStep(uuid string) error {
+	_, err := d.execCount(d.dialect.setSetting, d.cluster, resizeStepSetting, uuid)
+	return err
+}
+
+func (d *DB) selectLease(tx *sql.Tx) (Lease, bool, error) {
+	lease := Lease{}
+	holder := sql.NullString{}
+	valid := false
+	err := tx.QueryRow(d.q(`SELECT holder, term, expires > NOW() FROM cluster_lease WHERE cluster_id = ? FOR UPDATE`), d.cluster).
+		Scan(&holder, &lease.Term, &valid)
+	lease.Holder = holder.String
+	return lease, valid, err
+}
+
+func (d *DB) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := d.conn().Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (d *DB) execCount(sql string, args ...interface{}) (int64, error) {
-	res, err := d.db.Exec(sql, args...)
+	res, err := d.conn().Exec(d.q(sql), args...)
 	if err != nil {
 		return 0, err
 	}
@@ -209,6 +528,10 @@ func (d *DB) execCount(sql string, args ...interface{}) (int64, error) {
 	return res.RowsAffected()
 }
 
+func (d *DB) q(query string) string {
+	return d.dialect.rebind(query)
+}
+
 type NullStringWrapper struct {
 	sql.NullString
 	String *string
@@ -218,6 +541,6 @@ func (n *NullStringWrapper) Scan(value interface{}) error {
 	if err := n.NullString.Scan(value); err != nil {
 		return err
 	}
-	n.String = &n.NullString.String
+	*n.String = n.NullString.String
 	return nil
 }
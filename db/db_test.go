@@ -0,0 +1,20 @@
+package db
+
+import "testing"
+
+func TestNullStringWrapper(t *testing.T) {
+	value := "unchanged"
+	if err := (&NullStringWrapper{String: &value}).Scan([]byte(`{"redis":7000}`)); err != nil {
+		t.Fatal(err)
+	}
+	if value != `{"redis":7000}` {
+		t.Fatalf("Expected scanned value to be written to target, got %s", value)
+	}
+
+	if err := (&NullStringWrapper{String: &value}).Scan(nil); err != nil {
+		t.Fatal(err)
+	}
+	if value != "" {
+		t.Fatalf("Expected NULL to scan as empty string, got %s", value)
+	}
+}
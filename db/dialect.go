@@ -0,0 +1,119 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+
+	mysqlDuplicateKey       = 1062
+	postgresUniqueViolation = "23505"
+)
+
+type dialect struct {
+	name       string
+	migrations []migration
+	// lock and unlock take and release the schema lock named by their only parameter. lock may give up
+	// early and return false, it is retried until schemaLockTimeout.
+	lock   string
+	unlock string
+	// seedLease inserts the lease row for a cluster unless it exists
+	seedLease string
+	// setSetting upserts a cluster setting from cluster, name and value
+	setSetting string
+	// versionTable creates the table recording applied migrations
+	versionTable string
+}
+
+var dialects = map[string]dialect{
+	MySQL: {
+		name:       MySQL,
+		migrations: mysqlMigrations,
+		lock:       "SELECT GET_LOCK(?, 1) = 1",
+		unlock:     "SELECT RELEASE_LOCK(?)",
+		seedLease:  "INSERT IGNORE INTO cluster_lease (cluster_id, term, expires) VALUES (?, 0, NOW())",
+		setSetting: "INSERT INTO cluster_setting(cluster_id, name, value) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		versionTable: "CREATE TABLE IF NOT EXISTS `cluster_schema_version` (" +
+			"`version` int(11) NOT NULL," +
+			"`name` varchar(256) NOT NULL," +
+			"`applied` datetime NOT NULL," +
+			" PRIMARY KEY (version)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	},
+	Postgres: {
+		name:       Postgres,
+		migrations: postgresMigrations,
+		lock:       "SELECT true FROM (SELECT pg_advisory_lock(hashtext(?))) AS l",
+		unlock:     "SELECT pg_advisory_unlock(hashtext(?))",
+		seedLease:  "INSERT INTO cluster_lease (cluster_id, term, expires) VALUES (?, 0, NOW()) ON CONFLICT DO NOTHING",
+		setSetting: "INSERT INTO cluster_setting(cluster_id, name, value) VALUES(?, ?, ?) " +
+			"ON CONFLICT (cluster_id, name) DO UPDATE SET value = EXCLUDED.value",
+		versionTable: "CREATE TABLE IF NOT EXISTS cluster_schema_version (" +
+			"version integer PRIMARY KEY," +
+			"name varchar(256) NOT NULL," +
+			"applied timestamp NOT NULL)",
+	},
+}
+
+// since returns the whole seconds elapsed since the datetime column
+func (d dialect) since(column string) string {
+	if d.name == Postgres {
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM (NOW() - %s)) AS bigint)", column)
+	}
+	return fmt.Sprintf("TIMESTAMPDIFF(SECOND, %s, NOW())", column)
+}
+
+// fromNow returns a datetime the number of seconds given by the next parameter in the future
+func (d dialect) fromNow() string {
+	if d.name == Postgres {
+		return "NOW() + CAST(? AS integer) * INTERVAL '1 second'"
+	}
+	return "DATE_ADD(NOW(), INTERVAL ? SECOND)"
+}
+
+func (d dialect) epoch(column string) string {
+	if d.name == Postgres {
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM %s) AS bigint)", column)
+	}
+	return fmt.Sprintf("UNIX_TIMESTAMP(%s)", column)
+}
+
+// rebind rewrites ? placeholders to $1, $2... for drivers that need numbered parameters
+func (d dialect) rebind(query string) string {
+	if d.name != Postgres {
+		return query
+	}
+
+	buf := bytes.Buffer{}
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == mysqlDuplicateKey
+	case *pq.Error:
+		return e.Code == postgresUniqueViolation
+	}
+	return false
+}
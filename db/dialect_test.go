@@ -0,0 +1,15 @@
+package db
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := "SELECT a FROM t WHERE b = ? AND c = '?' AND d = ?"
+	if got := dialects[MySQL].rebind(query); got != query {
+		t.Fatalf("Expected MySQL query to be unchanged, got %s", got)
+	}
+
+	expected := "SELECT a FROM t WHERE b = $1 AND c = '?' AND d = $2"
+	if got := dialects[Postgres].rebind(query); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import "database/sql"
+
+type Endpoint struct {
+	// Name identifies the endpoint in logs and status without exposing credentials, usually host:port
+	Name string
+	DSN  string
+}
+
+func (d *DB) Endpoint() string {
+	d.RLock()
+	defer d.RUnlock()
+	return d.endpoints[d.active].Name
+}
+
+// Ping checks the active endpoint and, when it fails, switches to the first healthy endpoint in the
+// configured order. It only fails when no endpoint is reachable.
+func (d *DB) Ping() error {
+	d.closeRetired()
+
+	err := d.conn().Ping()
+	if err == nil {
+		return nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for i, endpoint := range d.endpoints {
+		if i == d.active {
+			continue
+		}
+
+		db, openErr := sql.Open(d.driver, endpoint.DSN)
+		if openErr != nil {
+			log.WithField("err", openErr).Errorf("Failed to open database %s", endpoint.Name)
+			continue
+		}
+		if pingErr := db.Ping(); pingErr != nil {
+			log.WithField("err", pingErr).Warnf("Database %s is unavailable", endpoint.Name)
+			db.Close()
+			continue
+		}
+
+		log.WithField("err", err).Warnf("Database %s is unavailable, switching to %s", d.endpoints[d.active].Name, endpoint.Name)
+		d.pool.apply(db)
+		d.retired, d.db = d.db, db
+		d.active = i
+		return nil
+	}
+
+	return err
+}
+
+func (d *DB) closeRetired() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.retired != nil {
+		d.retired.Close()
+		d.retired = nil
+	}
+}
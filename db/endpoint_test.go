@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+var healthy = map[string]bool{}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	if !healthy[dsn] {
+		return nil, errors.New("Connection refused")
+	}
+	return fakeConn{dsn}, nil
+}
+
+type fakeConn struct {
+	dsn string
+}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("Not implemented") }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("Not implemented") }
+
+func (f fakeConn) Ping(ctx context.Context) error {
+	if !healthy[f.dsn] {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+func TestPingFailover(t *testing.T) {
+	endpoints := []Endpoint{{Name: "a:3306", DSN: "a"}, {Name: "b:3306", DSN: "b"}, {Name: "c:3306", DSN: "c"}}
+	conn, err := sql.Open("fake", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DB{db: conn, driver: "fake", endpoints: endpoints}
+
+	healthy["a"], healthy["c"] = true, true
+	if err := d.Ping(); err != nil || d.Endpoint() != "a:3306" {
+		t.Fatalf("Expected to stay on a, got %s %v", d.Endpoint(), err)
+	}
+
+	healthy["a"] = false
+	if err := d.Ping(); err != nil || d.Endpoint() != "c:3306" {
+		t.Fatalf("Expected to fail over to c, got %s %v", d.Endpoint(), err)
+	}
+
+	healthy["a"] = true
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("Expected the pool for a to stay open for callers still using it: %v", err)
+	}
+	if err := d.Ping(); err != nil || d.Endpoint() != "c:3306" {
+		t.Fatalf("Expected to stay on c while it is healthy, got %s %v", d.Endpoint(), err)
+	}
+	if err := conn.Ping(); err == nil {
+		t.Fatal("Expected the pool for a to be closed on the next ping")
+	}
+
+	healthy["a"], healthy["c"] = false, false
+	if err := d.Ping(); err == nil {
+		t.Fatal("Expected an error with no healthy endpoint")
+	}
+}
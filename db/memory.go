@@ -0,0 +1,326 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MemoryStore struct {
+	sync.Mutex
+	lastID    int
+	members   map[string]Member
+	lastSeen  map[string]time.Time
+	accessKey string
+	secretKey string
+	lease     Lease
+	expires   time.Time
+	excluded  string
+	exclusion time.Time
+	size      int
+	step      string
+	events    []Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		members:  map[string]Member{},
+		lastSeen: map[string]time.Time{},
+	}
+}
+
+func (m *MemoryStore) SetAPIKeys(accessKey, secretKey string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.accessKey = accessKey
+	m.secretKey = secretKey
+}
+
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+func (m *MemoryStore) Endpoint() string {
+	return "memory"
+}
+
+func (m *MemoryStore) Members() ([]Member, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := Members{}
+	for uuid, member := range m.members {
+		member.HeartbeatAge = time.Since(m.lastSeen[uuid])
+		result = append(result, member)
+	}
+	sort.Sort(result)
+
+	return result, nil
+}
+
+func (m *MemoryStore) APIKeys() (string, string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.accessKey == "" && m.secretKey == "" {
+		return "", "", errors.New("Waiting for API keys for service account")
+	}
+
+	return m.accessKey, m.secretKey, nil
+}
+
+func (m *MemoryStore) Delete(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.members, uuid)
+	delete(m.lastSeen, uuid)
+	return nil
+}
+
+func (m *MemoryStore) SetDraining(uuid string, draining bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	member, ok := m.members[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	member.Draining = draining
+	m.members[uuid] = member
+	return nil
+}
+
+func (m *MemoryStore) Leave(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	member, ok := m.members[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	member.Leaving = true
+	m.members[uuid] = member
+	return nil
+}
+
+func (m *MemoryStore) Evict(term int64, uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.checkTerm(term); err != nil {
+		return err
+	}
+
+	delete(m.members, uuid)
+	delete(m.lastSeen, uuid)
+	return nil
+}
+
+func (m *MemoryStore) Checkin(member Member, i int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.lastSeen[member.UUID] = time.Now()
+	if existing, ok := m.members[member.UUID]; ok {
+		existing.Heartbeat = i
+		existing.Name = member.Name
+		existing.IP = member.IP
+		existing.Ports = copyPorts(member.Ports)
+		existing.KeyID = member.KeyID
+		existing.ClusterSize = member.ClusterSize
+		existing.Leaving = false
+		m.members[member.UUID] = existing
+		return nil
+	}
+
+	m.lastID++
+	m.recordEvent(Event{
+		Actor:  member.UUID,
+		Event:  EventJoin,
+		Target: member.UUID,
+		Reason: "Checked in as " + member.IP,
+	})
+	m.members[member.UUID] = Member{
+		ID:             m.lastID,
+		Name:           member.Name,
+		UUID:           member.UUID,
+		IP:             member.IP,
+		RequestedIndex: member.RequestedIndex,
+		Ports:          copyPorts(member.Ports),
+		KeyID:          member.KeyID,
+		ClusterSize:    member.ClusterSize,
+	}
+
+	return nil
+}
+
+func copyPorts(ports map[string]int) map[string]int {
+	result := map[string]int{}
+	for k, v := range ports {
+		result[k] = v
+	}
+	return result
+}
+
+func (m *MemoryStore) AcquireLease(uuid string, ttl time.Duration) (Lease, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if uuid == m.excluded && now.Before(m.exclusion) && !now.Before(m.expires) {
+		return Lease{Term: m.lease.Term}, nil
+	}
+
+	if m.lease.Holder == uuid && now.Before(m.expires) {
+		m.expires = now.Add(ttl)
+	} else if !now.Before(m.expires) {
+		m.lease.Holder = uuid
+		m.lease.Term++
+		m.expires = now.Add(ttl)
+	}
+
+	return m.lease, nil
+}
+
+func (m *MemoryStore) Lease() (Lease, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !time.Now().Before(m.expires) {
+		return Lease{}, nil
+	}
+	return m.lease, nil
+}
+
+func (m *MemoryStore) StepDown(hold time.Duration) (Lease, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if !now.Before(m.expires) {
+		return Lease{}, nil
+	}
+
+	m.expires = now
+	m.excluded = m.lease.Holder
+	m.exclusion = now.Add(hold)
+	return m.lease, nil
+}
+
+func (m *MemoryStore) ReleaseLease(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.lease.Holder == uuid {
+		m.expires = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) CheckLease(uuid string, term int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.lease.Holder != uuid {
+		return ErrStaleTerm
+	}
+	return m.checkTerm(term)
+}
+
+func (m *MemoryStore) checkTerm(term int64) error {
+	if m.lease.Term != term || !time.Now().Before(m.expires) {
+		return ErrStaleTerm
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveIndex(term int64, release []Member, assign map[int]Member) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.checkTerm(term); err != nil {
+		return err
+	}
+
+	current := map[int]int{}
+	for _, member := range m.members {
+		current[member.ID] = member.Index
+	}
+
+	changes, err := planIndexes(current, release, assign)
+	if err != nil {
+		return err
+	}
+
+	for uuid, member := range m.members {
+		index, ok := changes[member.ID]
+		if !ok {
+			continue
+		}
+		member.Index = index
+		if index > 0 {
+			member.RequestedIndex = 0
+		}
+		m.members[uuid] = member
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) DesiredSize() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.size, nil
+}
+
+func (m *MemoryStore) SetDesiredSize(size int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.size = size
+	return nil
+}
+
+func (m *MemoryStore) ResizeStep() (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.step, nil
+}
+
+func (m *MemoryStore) SetResizeStep(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.step = uuid
+	return nil
+}
+
+func (m *MemoryStore) RecordEvent(event Event) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.recordEvent(event)
+	return nil
+}
+
+func (m *MemoryStore) recordEvent(event Event) {
+	event.ID = int64(len(m.events) + 1)
+	event.Created = time.Now()
+	m.events = append(m.events, event)
+}
+
+func (m *MemoryStore) Events(limit int) ([]Event, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := []Event{}
+	for i := len(m.events) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, m.events[i])
+	}
+	return result, nil
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreCheckin(t *testing.T) {
+	s := NewMemoryStore()
+
+	if err := s.Checkin(Member{UUID: "a", IP: "1.1.1.1", RequestedIndex: 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkin(Member{UUID: "b", IP: "1.1.1.2"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkin(Member{UUID: "a", IP: "1.1.1.1", Ports: map[string]int{Redis: 7000}}, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := s.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members, got %d", len(members))
+	}
+	if members[0].UUID != "a" || members[0].ID != 1 || members[0].Heartbeat != 5 || members[0].RequestedIndex != 2 ||
+		LookupPortByService(members[0].Ports, Redis) != 7000 {
+		t.Fatalf("Unexpected first member %#v", members[0])
+	}
+	if members[1].UUID != "b" || members[1].ID != 2 {
+		t.Fatalf("Unexpected second member %#v", members[1])
+	}
+
+	lease, err := s.AcquireLease("a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIndex(lease.Term, nil, map[int]Member{3: members[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err = s.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Index != 3 || members[0].RequestedIndex != 0 {
+		t.Fatalf("Unexpected members %#v", members)
+	}
+}
+
+func TestMemoryStoreAPIKeys(t *testing.T) {
+	s := NewMemoryStore()
+	if _, _, err := s.APIKeys(); err == nil {
+		t.Fatal("Expected error before keys are set")
+	}
+
+	s.SetAPIKeys("access", "secret")
+	a, b, err := s.APIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != "access" || b != "secret" {
+		t.Fatalf("Unexpected keys %s %s", a, b)
+	}
+}
+
+func TestMemoryStoreLease(t *testing.T) {
+	s := NewMemoryStore()
+
+	lease, err := s.AcquireLease("a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "a" || lease.Term != 1 {
+		t.Fatalf("Unexpected lease %#v", lease)
+	}
+
+	lease, err = s.AcquireLease("b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "a" || lease.Term != 1 {
+		t.Fatalf("Expected a to keep the lease, got %#v", lease)
+	}
+
+	if err := s.CheckLease("b", 1); err != ErrStaleTerm {
+		t.Fatalf("Expected stale term for b, got %v", err)
+	}
+
+	// Let a's lease expire
+	if _, err := s.AcquireLease("a", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err = s.AcquireLease("b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "b" || lease.Term != 2 {
+		t.Fatalf("Expected b to take over at term 2, got %#v", lease)
+	}
+
+	if err := s.CheckLease("a", 1); err != ErrStaleTerm {
+		t.Fatalf("Expected stale term for a, got %v", err)
+	}
+	if err := s.SaveIndex(1, nil, map[int]Member{}); err != ErrStaleTerm {
+		t.Fatalf("Expected stale term when saving with old term, got %v", err)
+	}
+	if err := s.SaveIndex(2, nil, map[int]Member{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreIndexConflict(t *testing.T) {
+	s := NewMemoryStore()
+	for _, uuid := range []string{"a", "b", "c"} {
+		if err := s.Checkin(Member{UUID: uuid}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lease, err := s.AcquireLease("a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := s.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIndex(lease.Term, nil, map[int]Member{1: stale[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SaveIndex(lease.Term, nil, map[int]Member{1: stale[1]}); err != ErrIndexConflict {
+		t.Fatalf("Expected conflict assigning a held index, got %v", err)
+	}
+	if err := s.SaveIndex(lease.Term, nil, map[int]Member{2: stale[0]}); err != ErrIndexConflict {
+		t.Fatalf("Expected conflict from a stale view of the member, got %v", err)
+	}
+
+	members, err := s.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIndex(lease.Term, []Member{members[0]}, map[int]Member{1: members[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err = s.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members[0].Index != 0 || members[1].Index != 1 || members[2].Index != 0 {
+		t.Fatalf("Expected index 1 to move from a to b, got %#v", members)
+	}
+}
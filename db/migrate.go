@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const schemaLock = "cluster_schema"
+
+// schemaLockTimeout bounds the wait for another member's migration. Each GET_LOCK attempt only waits a
+// second so the query returns well inside the read timeout of the MySQL connection.
+const schemaLockTimeout = 60 * time.Second
+
+type migration struct {
+	version int
+	name    string
+	steps   []step
+}
+
+type step func(conn *sql.Conn) error
+
+var mysqlMigrations = []migration{
+	{1, "create cluster", []step{
+		exec("CREATE TABLE IF NOT EXISTS `cluster` (" +
+			"`id` bigint(20) NOT NULL AUTO_INCREMENT," +
+			"`name` varchar(256) DEFAULT NULL," +
+			"`heartbeat` bigint(20) DEFAULT 0 NOT NULL," +
+			"`uuid` varchar(128) NOT NULL," +
+			"`ip_address` varchar(128) NOT NULL," +
+			"`requested_index` int(11) NOT NULL," +
+			"`assigned_index` int(11) DEFAULT 0 NOT NULL," +
+			"`ports` varchar(1024)," +
+			" PRIMARY KEY (id)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8"),
+	}},
+	{2, "add cluster last_seen", []step{
+		addColumn("cluster", "last_seen", "datetime DEFAULT NULL"),
+		// Give members from before the upgrade one timeout to check in
+		exec("UPDATE `cluster` SET last_seen = NOW() WHERE last_seen IS NULL"),
+	}},
+	{3, "create cluster_lease", []step{
+		exec("CREATE TABLE IF NOT EXISTS `cluster_lease` (" +
+			"`id` int(11) NOT NULL," +
+			"`holder` varchar(128) DEFAULT NULL," +
+			"`term` bigint(20) DEFAULT 0 NOT NULL," +
+			"`expires` datetime NOT NULL," +
+			" PRIMARY KEY (id)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8"),
+		exec("INSERT IGNORE INTO `cluster_lease` (id, term, expires) VALUES (1, 0, NOW())"),
+	}},
+	{4, "create cluster_setting", []step{
+		exec("CREATE TABLE IF NOT EXISTS `cluster_setting` (" +
+			"`name` varchar(128) NOT NULL," +
+			"`value` varchar(1024) DEFAULT NULL," +
+			" PRIMARY KEY (name)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8"),
+	}},
+	{5, "create cluster_event", []step{
+		exec("CREATE TABLE IF NOT EXISTS `cluster_event` (" +
+			"`id` bigint(20) NOT NULL AUTO_INCREMENT," +
+			"`created` datetime NOT NULL," +
+			"`actor` varchar(128) NOT NULL," +
+			"`event` varchar(64) NOT NULL," +
+			"`target` varchar(128) DEFAULT NULL," +
+			"`reason` varchar(1024) DEFAULT NULL," +
+			" PRIMARY KEY (id)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8"),
+	}},
+	{6, "add cluster_lease exclusion", []step{
+		addColumn("cluster_lease", "excluded", "varchar(128) DEFAULT NULL"),
+		addColumn("cluster_lease", "excluded_until", "datetime DEFAULT NULL"),
+	}},
+	{7, "add cluster draining", []step{
+		addColumn("cluster", "draining", "tinyint(1) DEFAULT 0 NOT NULL"),
+	}},
+	{8, "scope tables by cluster", []step{
+		// Existing rows pick up the default so an upgraded install keeps its members, lease and settings
+		addColumn("cluster", "cluster_id", "varchar(128) DEFAULT '"+DefaultCluster+"' NOT NULL"),
+		addIndex("cluster", "idx_cluster_cluster_id", "cluster_id"),
+		addColumn("cluster_lease", "cluster_id", "varchar(128) DEFAULT '"+DefaultCluster+"' NOT NULL"),
+		primaryKey("cluster_lease", "cluster_id"),
+		dropColumn("cluster_lease", "id"),
+		addColumn("cluster_setting", "cluster_id", "varchar(128) DEFAULT '"+DefaultCluster+"' NOT NULL"),
+		primaryKey("cluster_setting", "cluster_id", "name"),
+		addColumn("cluster_event", "cluster_id", "varchar(128) DEFAULT '"+DefaultCluster+"' NOT NULL"),
+		addIndex("cluster_event", "idx_cluster_event_cluster_id", "cluster_id"),
+	}},
+	{9, "unique assigned index per cluster", []step{
+		exec("ALTER TABLE `cluster` MODIFY `assigned_index` int(11) DEFAULT NULL"),
+		exec("UPDATE `cluster` SET assigned_index = NULL WHERE assigned_index = 0"),
+		// Keep the oldest holder of any duplicated index, the master reassigns the rest
+		exec("UPDATE `cluster` c JOIN `cluster` o ON c.cluster_id = o.cluster_id AND c.assigned_index = o.assigned_index AND c.id > o.id " +
+			"SET c.assigned_index = NULL"),
+		addUniqueIndex("cluster", "uk_cluster_assigned_index", "cluster_id", "assigned_index"),
+	}},
+	{10, "add cluster key_id", []step{
+		addColumn("cluster", "key_id", "varchar(64) DEFAULT NULL"),
+	}},
+	{11, "add cluster cluster_size", []step{
+		addColumn("cluster", "cluster_size", "int(11) DEFAULT 0 NOT NULL"),
+	}},
+	{12, "add cluster leaving", []step{
+		addColumn("cluster", "leaving", "tinyint(1) DEFAULT 0 NOT NULL"),
+	}},
+}
+
+func exec(query string) step {
+	return func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), query)
+		return err
+	}
+}
+
+func addColumn(table, column, definition string) step {
+	return func(conn *sql.Conn) error {
+		exists, err := hasColumn(conn, table, column)
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition))
+		return err
+	}
+}
+
+func dropColumn(table, column string) step {
+	return func(conn *sql.Conn) error {
+		exists, err := hasColumn(conn, table, column)
+		if err != nil || !exists {
+			return err
+		}
+
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`", table, column))
+		return err
+	}
+}
+
+func addIndex(table, index string, columns ...string) step {
+	return createIndex(table, "INDEX", index, columns)
+}
+
+func addUniqueIndex(table, index string, columns ...string) step {
+	return createIndex(table, "UNIQUE INDEX", index, columns)
+}
+
+func createIndex(table, kind, index string, columns []string) step {
+	return func(conn *sql.Conn) error {
+		existing, err := indexColumns(conn, table, index)
+		if err != nil || existing != "" {
+			return err
+		}
+
+		_, err = conn.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE `%s` ADD %s `%s` (%s)", table, kind, index,
+			quoteColumns(columns)))
+		return err
+	}
+}
+
+func primaryKey(table string, columns ...string) step {
+	return func(conn *sql.Conn) error {
+		existing, err := indexColumns(conn, table, "PRIMARY")
+		if err != nil || existing == strings.Join(columns, ",") {
+			return err
+		}
+
+		alter := fmt.Sprintf("ALTER TABLE `%s` ADD PRIMARY KEY (%s)", table, quoteColumns(columns))
+		if existing != "" {
+			alter = fmt.Sprintf("ALTER TABLE `%s` DROP PRIMARY KEY, ADD PRIMARY KEY (%s)", table, quoteColumns(columns))
+		}
+		_, err = conn.ExecContext(context.Background(), alter)
+		return err
+	}
+}
+
+func hasColumn(conn *sql.Conn, table, column string) (bool, error) {
+	count := 0
+	err := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func indexColumns(conn *sql.Conn, table, index string) (string, error) {
+	columns := sql.NullString{}
+	err := conn.QueryRowContext(context.Background(), `SELECT GROUP_CONCAT(column_name ORDER BY seq_in_index)
+		FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`, table, index).Scan(&columns)
+	return columns.String, err
+}
+
+func quoteColumns(columns []string) string {
+	quoted := []string{}
+	for _, column := range columns {
+		quoted = append(quoted, "`"+column+"`")
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func latestVersion(migrations []migration) int {
+	return migrations[len(migrations)-1].version
+}
+
+func checkSchemaVersion(migrations []migration, current int) error {
+	if current > latestVersion(migrations) {
+		return fmt.Errorf("Database schema version %d is newer than version %d supported by this cluster manager, please upgrade",
+			current, latestVersion(migrations))
+	}
+	return nil
+}
+
+func (d *DB) Migrate() error {
+	ctx := context.Background()
+	conn, err := d.conn().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	locked := false
+	deadline := time.Now().Add(schemaLockTimeout)
+	for !locked {
+		if err := conn.QueryRowContext(ctx, d.q(d.dialect.lock), schemaLock).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked && time.Now().After(deadline) {
+			return fmt.Errorf("Timeout waiting for lock %s to migrate the database schema", schemaLock)
+		}
+	}
+	defer conn.ExecContext(ctx, d.q(d.dialect.unlock), schemaLock)
+
+	if _, err = conn.ExecContext(ctx, d.dialect.versionTable); err != nil {
+		return err
+	}
+
+	current := 0
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM cluster_schema_version").Scan(&current); err != nil {
+		return err
+	}
+
+	migrations := d.dialect.migrations
+	if err := checkSchemaVersion(migrations, current); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		log.Infof("Migrating database schema to version %d: %s", m.version, m.name)
+		for _, step := range m.steps {
+			if err := step(conn); err != nil {
+				return fmt.Errorf("Failed to migrate database schema to version %d: %v", m.version, err)
+			}
+		}
+
+		_, err := conn.ExecContext(ctx, d.q("INSERT INTO cluster_schema_version(version, name, applied) VALUES(?, ?, NOW())"),
+			m.version, m.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, d.q(d.dialect.seedLease), d.cluster)
+	return err
+}
@@ -0,0 +1,52 @@
+package db
+
+// Postgres support starts from the schema MySQL reached after its own migrations, so the history here
+// is shorter. New schema changes are added to both lists.
+var postgresMigrations = []migration{
+	{1, "create cluster tables", []step{
+		exec(`CREATE TABLE IF NOT EXISTS cluster (
+			id bigserial PRIMARY KEY,
+			cluster_id varchar(128) DEFAULT '` + DefaultCluster + `' NOT NULL,
+			name varchar(256),
+			heartbeat bigint DEFAULT 0 NOT NULL,
+			uuid varchar(128) NOT NULL,
+			ip_address varchar(128) NOT NULL,
+			requested_index integer NOT NULL,
+			assigned_index integer,
+			ports varchar(1024),
+			last_seen timestamp,
+			draining boolean DEFAULT false NOT NULL,
+			CONSTRAINT uk_cluster_assigned_index UNIQUE (cluster_id, assigned_index))`),
+		exec(`CREATE INDEX IF NOT EXISTS idx_cluster_cluster_id ON cluster (cluster_id)`),
+		exec(`CREATE TABLE IF NOT EXISTS cluster_lease (
+			cluster_id varchar(128) PRIMARY KEY,
+			holder varchar(128),
+			term bigint DEFAULT 0 NOT NULL,
+			expires timestamp NOT NULL,
+			excluded varchar(128),
+			excluded_until timestamp)`),
+		exec(`CREATE TABLE IF NOT EXISTS cluster_setting (
+			cluster_id varchar(128) NOT NULL,
+			name varchar(128) NOT NULL,
+			value varchar(1024),
+			PRIMARY KEY (cluster_id, name))`),
+		exec(`CREATE TABLE IF NOT EXISTS cluster_event (
+			id bigserial PRIMARY KEY,
+			cluster_id varchar(128) DEFAULT '` + DefaultCluster + `' NOT NULL,
+			created timestamp NOT NULL,
+			actor varchar(128) NOT NULL,
+			event varchar(64) NOT NULL,
+			target varchar(128),
+			reason varchar(1024))`),
+		exec(`CREATE INDEX IF NOT EXISTS idx_cluster_event_cluster_id ON cluster_event (cluster_id)`),
+	}},
+	{2, "add cluster key_id", []step{
+		exec(`ALTER TABLE cluster ADD COLUMN IF NOT EXISTS key_id varchar(64)`),
+	}},
+	{3, "add cluster cluster_size", []step{
+		exec(`ALTER TABLE cluster ADD COLUMN IF NOT EXISTS cluster_size integer DEFAULT 0 NOT NULL`),
+	}},
+	{4, "add cluster leaving", []step{
+		exec(`ALTER TABLE cluster ADD COLUMN IF NOT EXISTS leaving boolean DEFAULT false NOT NULL`),
+	}},
+}
@@ -0,0 +1,29 @@
+package db
+
+import "testing"
+
+func TestMigrationsOrdered(t *testing.T) {
+	for name, dialect := range dialects {
+		for i, m := range dialect.migrations {
+			if m.version != i+1 {
+				t.Fatalf("%s migration %q has version %d, expected %d", name, m.name, m.version, i+1)
+			}
+			if len(m.steps) == 0 {
+				t.Fatalf("%s migration %q has no steps", name, m.name)
+			}
+		}
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	latest := latestVersion(mysqlMigrations)
+	if err := checkSchemaVersion(mysqlMigrations, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchemaVersion(mysqlMigrations, latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchemaVersion(mysqlMigrations, latest+1); err == nil {
+		t.Fatal("Expected a newer schema version to be refused")
+	}
+}
@@ -0,0 +1,27 @@
+package db
+
+import "time"
+
+// Backoff doubles the wait between attempts from Initial up to Max
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	next    time.Duration
+}
+
+func (b *Backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.Initial
+	}
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+
+	wait := b.next
+	b.next *= 2
+	return wait
+}
+
+func (b *Backoff) Reset() {
+	b.next = 0
+}
@@ -0,0 +1,20 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}
+	for _, expected := range []time.Duration{1, 2, 4, 5, 5} {
+		if wait := b.Next(); wait != expected*time.Second {
+			t.Fatalf("Expected %v, got %v", expected*time.Second, wait)
+		}
+	}
+
+	b.Reset()
+	if wait := b.Next(); wait != time.Second {
+		t.Fatalf("Expected backoff to start over after reset, got %v", wait)
+	}
+}
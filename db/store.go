@@ -0,0 +1,104 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrStaleTerm = errors.New("Leader lease is not held at the given term")
+	ErrNotFound  = errors.New("Member not found")
+
+	ErrIndexConflict = errors.New("Index assignment conflicts with a concurrent change")
+)
+
+type Lease struct {
+	Holder string
+	Term   int64
+}
+
+const (
+	EventJoin         = "join"
+	EventLeave        = "leave"
+	EventEvict        = "evict"
+	EventAssignIndex  = "assign-index"
+	EventReleaseIndex = "release-index"
+	EventMaster       = "master"
+	EventResize       = "resize"
+	EventDrain        = "drain"
+	EventUndrain      = "undrain"
+)
+
+type Event struct {
+	ID      int64
+	Created time.Time
+	Actor   string
+	Event   string
+	Target  string
+	Reason  string
+}
+
+type MembershipStore interface {
+	Ping() error
+	Endpoint() string
+	Members() ([]Member, error)
+	Checkin(member Member, i int) error
+	Delete(uuid string) error
+	Evict(term int64, uuid string) error
+	SetDraining(uuid string, draining bool) error
+	Leave(uuid string) error
+	SaveIndex(term int64, release []Member, assign map[int]Member) error
+	APIKeys() (string, string, error)
+	AcquireLease(uuid string, ttl time.Duration) (Lease, error)
+	CheckLease(uuid string, term int64) error
+	ReleaseLease(uuid string) error
+	Lease() (Lease, error)
+	StepDown(hold time.Duration) (Lease, error)
+	DesiredSize() (int, error)
+	SetDesiredSize(size int) error
+	ResizeStep() (string, error)
+	SetResizeStep(uuid string) error
+	RecordEvent(event Event) error
+	Events(limit int) ([]Event, error)
+}
+
+// planIndexes checks the caller's view of each released and assigned member against the current
+// assigned index by member ID and returns the new index of every member that changes
+func planIndexes(current map[int]int, release []Member, assign map[int]Member) (map[int]int, error) {
+	changes := map[int]int{}
+	for _, member := range release {
+		if index, ok := current[member.ID]; !ok || index != member.Index {
+			return nil, ErrIndexConflict
+		}
+		changes[member.ID] = 0
+	}
+
+	for index, member := range assign {
+		if existing, ok := current[member.ID]; !ok || existing != member.Index {
+			return nil, ErrIndexConflict
+		}
+		if previous := changes[member.ID]; previous > 0 {
+			return nil, ErrIndexConflict
+		}
+		changes[member.ID] = index
+	}
+
+	owners := map[int]int{}
+	for id, index := range current {
+		if changed, ok := changes[id]; ok {
+			if changed == index {
+				delete(changes, id)
+			}
+			index = changed
+		}
+		if index <= 0 {
+			continue
+		}
+		if _, ok := owners[index]; ok {
+			return nil, ErrIndexConflict
+		}
+		owners[index] = id
+	}
+
+	return changes, nil
+}
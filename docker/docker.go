@@ -2,6 +2,7 @@ package docker
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,8 +13,6 @@ import (
 	"regexp"
 	"strings"
 
-	"golang.org/x/net/context"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/term"
@@ -24,10 +23,12 @@ import (
 	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/go-connections/nat"
 	"github.com/rancher/cluster-manager/db"
+	"github.com/rancher/cluster-manager/metrics"
 )
 
 const (
 	ConfigDirDest = "/var/lib/rancher/etc"
+	Redacted      = "<redacted>"
 )
 
 var (
@@ -66,6 +67,11 @@ type Docker struct {
 	portMap    map[string]int
 }
 
+type ContainerStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
 type Container struct {
 	Name          string
 	Image         string
@@ -95,6 +101,13 @@ func New(configDir, prefix, image string, portMap map[string]int, defaultEnv map
 	}, err
 }
 
+// Configure replaces the settings applied to every container, containers pick them up when next launched
+func (d *Docker) Configure(image string, portMap map[string]int, defaultEnv map[string]string) {
+	d.image = image
+	d.portMap = portMap
+	d.defaultEnv = defaultEnv
+}
+
 func (d *Docker) Name() (string, error) {
 	i, err := d.Cli.Info()
 	return i.Name, err
@@ -130,6 +143,17 @@ func (d *Docker) Delete(name string) error {
 	})
 }
 
+func (d *Docker) DeleteIfExists(name string) error {
+	c, err := d.Cli.ContainerInspect(name)
+	if client.IsErrContainerNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return d.deleteContainer(c.ID)
+}
+
 func (d *Docker) GetBridgeIP() (string, error) {
 	bridge, err := d.Cli.NetworkInspect("bridge")
 	if err != nil {
@@ -156,11 +180,11 @@ func (d *Docker) GetBridgeIP() (string, error) {
 	return net.IPv4(b[0], b[1], b[2], b[3]).String(), nil
 }
 
-func (d *Docker) shouldDelete(container Container, c types.ContainerJSON) bool {
-	changed := false
+func (d *Docker) shouldDelete(container Container, c types.ContainerJSON) []string {
+	reasons := []string{}
 	if !reflect.DeepEqual([]string(c.Config.Cmd), container.Command) {
 		log.Infof("Container %s command is different %v != %v", container.Name, c.Config.Cmd, container.Command)
-		changed = true
+		reasons = append(reasons, "command")
 	}
 
 	image := container.Image
@@ -169,9 +193,10 @@ func (d *Docker) shouldDelete(container Container, c types.ContainerJSON) bool {
 	}
 	if image != c.Config.Image {
 		log.Infof("Container %s image is different %v != %v", container.Name, image, c.Config.Image)
-		changed = true
+		reasons = append(reasons, "image")
 	}
 
+	envChanged := false
 	for k, v := range container.Env {
 		envStr := fmt.Sprintf("%s=%s", k, v)
 		found := false
@@ -182,17 +207,103 @@ func (d *Docker) shouldDelete(container Container, c types.ContainerJSON) bool {
 			}
 		}
 		if !found {
-			log.Infof("Container %s is missing env %s=%s", container.Name, k, v)
-			changed = true
+			log.Infof("Container %s is missing env %s=%s", container.Name, k, RedactEnvValue(k, v))
+			envChanged = true
 		}
 	}
+	if envChanged {
+		reasons = append(reasons, "env")
+	}
+
+	if container.Networking && !d.samePorts(container, c) {
+		log.Infof("Container %s port bindings are different %v", container.Name, container.Ports)
+		reasons = append(reasons, "ports")
+	}
 
 	if c.State == nil || !c.State.Running || c.State.Restarting {
 		log.Infof("Container %s is not running in state %#v", container.Name, c.State)
-		changed = true
+		reasons = append(reasons, "not_running")
+	}
+
+	return reasons
+}
+
+func (d *Docker) Status(name string) (ContainerStatus, error) {
+	status := ContainerStatus{
+		Name: d.prefix + name,
+	}
+
+	c, err := d.Cli.ContainerInspect(status.Name)
+	switch {
+	case client.IsErrContainerNotFound(err):
+		status.State = "missing"
+	case err != nil:
+		return status, err
+	case c.State == nil:
+		status.State = "unknown"
+	case c.State.Restarting:
+		status.State = "restarting"
+	case c.State.Running:
+		status.State = "running"
+	default:
+		status.State = c.State.Status
 	}
 
-	return changed
+	return status, nil
+}
+
+func (d *Docker) StopAll() error {
+	self, _ := findContainerID()
+
+	labels := filters.NewArgs()
+	labels.Add("label", "io.rancher.ha.container=true")
+	cls, err := d.Cli.ContainerList(types.ContainerListOptions{
+		Filter: labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The parent owns the network namespace, so it goes last
+	var parent *types.Container
+	for i, toStop := range cls {
+		if toStop.ID == self {
+			continue
+		}
+		if toStop.Labels["io.rancher.ha.service.name"] == Parent.Name {
+			parent = &cls[i]
+			continue
+		}
+		if err := d.stopContainer(toStop.ID); err != nil {
+			return err
+		}
+	}
+
+	if parent != nil {
+		return d.stopContainer(parent.ID)
+	}
+
+	return nil
+}
+
+func (d *Docker) Stop(name string) error {
+	c, err := d.Cli.ContainerInspect(name)
+	if client.IsErrContainerNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if c.State == nil || !c.State.Running {
+		return nil
+	}
+
+	return d.stopContainer(c.ID)
+}
+
+func (d *Docker) stopContainer(id string) error {
+	log.Infof("Stopping container %s", id)
+	return d.Cli.ContainerStop(id, 10)
 }
 
 func (d *Docker) deleteContainers(deleteLabels map[string]string) error {
@@ -243,12 +354,18 @@ func (d *Docker) recreate(containerDef Container) (types.ContainerJSON, error) {
 	}
 
 	exists := (err == nil)
-	if exists && d.shouldDelete(containerDef, c) {
+	reason := "missing"
+	if exists {
+		reasons := d.shouldDelete(containerDef, c)
+		if len(reasons) == 0 {
+			return c, nil
+		}
+
+		// Count each recreation once, under the first difference found
+		reason = reasons[0]
 		if err := d.deleteContainer(c.ID); err != nil {
 			return c, err
 		}
-	} else if exists {
-		return c, nil
 	}
 
 	if err := d.deleteContainers(containerDef.DeleteLabeled); err != nil {
@@ -309,6 +426,7 @@ func (d *Docker) recreate(containerDef Container) (types.ContainerJSON, error) {
 	}
 
 	log.Infof("Creating container %s%s", d.prefix, containerDef.Name)
+	metrics.ContainerRecreations.Inc(containerDef.Name, reason)
 	resp, err := d.Cli.ContainerCreate(&config, &hostConfig, nil, d.prefix+containerDef.Name)
 	if client.IsErrImageNotFound(err) {
 		distributionRef, err := reference.ParseNamed(config.Image)
@@ -341,6 +459,31 @@ func (d *Docker) recreate(containerDef Container) (types.ContainerJSON, error) {
 	return d.Cli.ContainerInspect(resp.ID)
 }
 
+func (d *Docker) samePorts(containerDef Container, c types.ContainerJSON) bool {
+	config := container.Config{ExposedPorts: map[nat.Port]struct{}{}}
+	hostConfig := container.HostConfig{PortBindings: nat.PortMap{}}
+	for _, port := range containerDef.Ports {
+		if err := d.setPort(port, &config, &hostConfig); err != nil {
+			// Can't tell without the bridge, leave the container alone
+			return true
+		}
+	}
+
+	if c.HostConfig == nil {
+		return len(hostConfig.PortBindings) == 0
+	}
+	if len(c.HostConfig.PortBindings) != len(hostConfig.PortBindings) {
+		return false
+	}
+	for port, bindings := range hostConfig.PortBindings {
+		actual := c.HostConfig.PortBindings[port]
+		if len(actual) != len(bindings) || actual[0].HostPort != bindings[0].HostPort {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *Docker) setPort(portSpec string, config *container.Config, hostConfig *container.HostConfig) error {
 	parts := strings.Split(portSpec, ":")
 	config.ExposedPorts[nat.Port(parts[len(parts)-1])] = struct{}{}
@@ -372,6 +515,30 @@ func (d *Docker) setPort(portSpec string, config *container.Config, hostConfig *
 	return nil
 }
 
+// IsSecretEnv reports whether an environment variable looks like it holds a credential
+func IsSecretEnv(key string) bool {
+	key = strings.ToUpper(key)
+	if strings.HasSuffix(key, "_FILE") || strings.HasSuffix(key, "_PATH") {
+		return false
+	}
+	for _, word := range []string{"PASSWORD", "SECRET", "TOKEN"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return strings.HasSuffix(key, "_KEY")
+}
+
+// urlPassword matches password parameters in URLs, such as the keystore passwords in a JDBC URL
+var urlPassword = regexp.MustCompile(`(?i)(password=)[^&]*`)
+
+func RedactEnvValue(key, value string) string {
+	if IsSecretEnv(key) && value != "" {
+		return Redacted
+	}
+	return urlPassword.ReplaceAllString(value, "${1}"+Redacted)
+}
+
 func ToEnv(env ...map[string]string) []string {
 	envs := []string{}
 	for _, e := range env {
@@ -418,6 +585,16 @@ func findContainerID() (string, error) {
 	return "", fmt.Errorf("Failed to find container id:\n%s", string(content))
 }
 
+func EngineID() (string, error) {
+	c, err := New("", "", "", nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	i, err := c.Cli.Info()
+	return i.ID, err
+}
+
 func GetImageAndEnv() (string, map[string]string, bool) {
 	id, err := findContainerID()
 	if err != nil {
@@ -1,40 +1,72 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/cluster-manager/api"
 	"github.com/rancher/cluster-manager/cluster"
 	"github.com/rancher/cluster-manager/config"
+	"github.com/rancher/cluster-manager/db"
 	"github.com/satori/go.uuid"
 )
 
 func main() {
 	c := &config.Config{
-		UUID:              uuid.NewV4().String(),
-		ContainerPrefix:   "rancher-ha-",
-		ClusterSize:       3,
-		DockerSocket:      "/var/run/docker.sock",
-		DBUser:            "cattle",
-		DBPassword:        "cattle",
-		DBHost:            "mysql",
-		DBPort:            3306,
-		DBName:            "cattle",
-		SwarmEnabled:      true,
-		HTTPEnabled:       true,
-		ConfigPath:        "/var/lib/rancher/etc",
-		CertPath:          "ssl/server-cert.pem",
-		KeyPath:           "ssl/server-key.pem",
-		CertChainPath:     "ssl/ca.crt",
-		EncryptionKeyPath: "server/encryption.key",
+		UUID:               uuid.NewV4().String(),
+		ClusterID:          db.DefaultCluster,
+		ContainerPrefix:    "rancher-ha-",
+		ClusterSize:        3,
+		DockerSocket:       "/var/run/docker.sock",
+		HeartbeatInterval:  5 * time.Second,
+		HeartbeatMissed:    2,
+		LeaveGrace:         time.Minute,
+		StatusPort:         18090,
+		DBType:             db.MySQL,
+		DBUser:             "cattle",
+		DBPassword:         "cattle",
+		DBHost:             "mysql",
+		DBPort:             3306,
+		DBName:             "cattle",
+		DBTimeout:          10 * time.Second,
+		DBMaxOpenConns:     10,
+		DBMaxIdleConns:     2,
+		DBConnMaxLifetime:  5 * time.Minute,
+		DBStartupTimeout:   5 * time.Minute,
+		DBRetryMaxInterval: 30 * time.Second,
+		ConfigPath:         "/var/lib/rancher/etc",
+		ConfigFile:         "cluster/config.json",
+		CertPath:           "ssl/server-cert.pem",
+		KeyPath:            "ssl/server-key.pem",
+		CertChainPath:      "ssl/ca.crt",
+		EncryptionKeyPath:  "server/encryption.key",
+		KeyringPath:        "server/encryption.keyring",
+		UUIDPath:           "cluster/uuid",
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(c, os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	c.LoadConfig()
+	run(c)
+}
 
-	if c.ClusterSize == 1 && c.ClusterIP == "" {
-		c.ClusterIP = "127.0.0.1"
+func run(c *config.Config) {
+	if err := c.LoadConfig(); err != nil {
+		logrus.WithField("err", err).Fatalf("Failed to load configuration")
 	}
 
-	if c.ClusterIP == "" {
-		logrus.Fatalf("CATTLE_HA_CLUSTER_IP must be set")
+	if err := c.Validate(); err != nil {
+		logrus.Fatal(err)
 	}
 
 	if err := c.OpenDB(); err != nil {
@@ -46,7 +78,33 @@ func main() {
 		logrus.WithField("err", err).Fatalf("Failed to create manager")
 	}
 
-	if err := cluster.Start(); err != nil {
+	if c.StatusPort > 0 {
+		go func() {
+			if err := api.New(cluster).ListenAndServe(c.StatusPort); err != nil {
+				logrus.WithField("err", err).Errorf("Failed to serve cluster status")
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig).Info("Shutting down")
+		cancel()
+	}()
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			logrus.Info("Received SIGHUP, reloading configuration")
+			cluster.Reload()
+		}
+	}()
+
+	if err := cluster.Start(ctx); err != nil {
 		logrus.WithField("err", err).Fatalf("Failed to create manager")
 	}
 }
@@ -0,0 +1,26 @@
+package metrics
+
+var (
+	MembersLive = NewGauge("cluster_manager_members_live",
+		"Number of cluster members with a heartbeat inside the timeout")
+	ClusterSize = NewGauge("cluster_manager_cluster_size",
+		"Configured number of cluster members")
+	Master = NewGauge("cluster_manager_master",
+		"Whether this node currently holds the leader lease")
+	HeartbeatAge = NewGauge("cluster_manager_member_heartbeat_age_seconds",
+		"Seconds since each member last checked in", "uuid", "name", "ip")
+	DBAvailable = NewGauge("cluster_manager_db_available",
+		"Whether the membership database is reachable")
+	LoopIterations = NewCounter("cluster_manager_loop_iterations_total",
+		"Number of reconcile loop iterations")
+	LoopErrors = NewCounter("cluster_manager_loop_errors_total",
+		"Number of reconcile loop iterations that failed")
+	IndexConflicts = NewCounter("cluster_manager_index_conflicts_total",
+		"Number of index assignments rejected because of a concurrent change")
+	ContainerRecreations = NewCounter("cluster_manager_container_recreations_total",
+		"Number of managed containers created, by the first reason found or missing", "container", "reason")
+	WaitForRancherDuration = NewHistogram("cluster_manager_wait_for_rancher_duration_seconds",
+		"Time spent checking that the Rancher server is available", DefaultBuckets)
+	WaitForHostsDuration = NewHistogram("cluster_manager_wait_for_hosts_duration_seconds",
+		"Time spent waiting for hosts to become active", DefaultBuckets)
+)
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	log = logrus.WithField("component", "metrics")
+
+	// registry holds only the cluster manager's own metrics
+	registry = prometheus.NewRegistry()
+
+	DefaultBuckets = []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+type Gauge struct {
+	*prometheus.GaugeVec
+}
+
+type Counter struct {
+	*prometheus.CounterVec
+}
+
+type Histogram struct {
+	*prometheus.HistogramVec
+}
+
+func NewGauge(name, help string, labelNames ...string) Gauge {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+	registry.MustRegister(g)
+	return Gauge{g}
+}
+
+func NewCounter(name, help string, labelNames ...string) Counter {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+	registry.MustRegister(c)
+	return Counter{c}
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) Histogram {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+	registry.MustRegister(h)
+	return Histogram{h}
+}
+
+// Set and the other updates log a label mismatch instead of panicking, a broken metric must not stop the manager
+func (g Gauge) Set(value float64, labelValues ...string) {
+	gauge, err := g.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.WithField("err", err).Error("Failed to set gauge")
+		return
+	}
+	gauge.Set(value)
+}
+
+func (g Gauge) SetBool(value bool, labelValues ...string) {
+	if value {
+		g.Set(1, labelValues...)
+	} else {
+		g.Set(0, labelValues...)
+	}
+}
+
+func (c Counter) Inc(labelValues ...string) {
+	counter, err := c.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.WithField("err", err).Error("Failed to increment counter")
+		return
+	}
+	counter.Inc()
+}
+
+func (h Histogram) Observe(value float64, labelValues ...string) {
+	histogram, err := h.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.WithField("err", err).Error("Failed to observe histogram")
+		return
+	}
+	histogram.Observe(value)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
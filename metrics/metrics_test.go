@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func scrape() string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	registry = prometheus.NewRegistry()
+
+	gauge := NewGauge("test_gauge", "A gauge", "name")
+	counter := NewCounter("test_counter", "A counter")
+	histogram := NewHistogram("test_histogram", "A histogram", []float64{1, 5})
+
+	gauge.Set(2.5, "a")
+	gauge.SetBool(true, "b\"")
+	counter.Inc()
+	counter.Inc()
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	// A label mismatch is logged, not a panic
+	gauge.Set(1)
+	counter.Inc("extra")
+
+	expected := `# HELP test_counter A counter
+# TYPE test_counter counter
+test_counter 2
+# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge{name="a"} 2.5
+test_gauge{name="b\""} 1
+# HELP test_histogram A histogram
+# TYPE test_histogram histogram
+test_histogram_bucket{le="1"} 1
+test_histogram_bucket{le="5"} 2
+test_histogram_bucket{le="+Inf"} 2
+test_histogram_sum 3.5
+test_histogram_count 2
+`
+	if out := scrape(); out != expected {
+		t.Fatalf("Unexpected output:\n%s", out)
+	}
+
+	gauge.Reset()
+	if out := scrape(); strings.Contains(out, "test_gauge{") {
+		t.Fatalf("Expected gauge to be empty after reset:\n%s", out)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	// not needed, working around goimports issue in vim
 	_ "github.com/docker/machine/libmachine/log"
+	"github.com/rancher/cluster-manager/metrics"
 	"github.com/rancher/go-rancher/client"
 )
 
@@ -30,6 +31,8 @@ func init() {
 }
 
 func WaitForHosts(accessKey, secretKey, url string, count int) error {
+	defer observeSince(metrics.WaitForHostsDuration, time.Now())
+
 	c, err := client.NewRancherClient(&client.ClientOpts{
 		Url:       url,
 		AccessKey: accessKey,
@@ -254,6 +257,8 @@ func saveCert(cert *client.Certificate, configPath, chainPath string) error {
 }
 
 func WaitForRancher(url string) bool {
+	defer observeSince(metrics.WaitForRancherDuration, time.Now())
+
 	if !Ping(url) {
 		log.Infof("Waiting for server to be available")
 		return false
@@ -261,6 +266,10 @@ func WaitForRancher(url string) bool {
 	return true
 }
 
+func observeSince(h metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
 func Ping(url string) bool {
 	resp, err := http.Get(url)
 	if err != nil {
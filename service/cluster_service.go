@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
@@ -23,16 +24,26 @@ var (
 
 type clusterState struct {
 	cluster        []string
+	ports          []map[string]int
 	clusterByIndex map[int]db.Member
 	index          int
+	size           int
+}
+
+type Status struct {
+	Index      int                      `json:"index"`
+	Cluster    []string                 `json:"cluster"`
+	Containers []docker.ContainerStatus `json:"containers"`
 }
 
 type ClusterService struct {
+	sync.Mutex
 	tunnel        *TunnelFactory
 	config        *config.Config
 	d             *docker.Docker
 	state         clusterState
 	launchedStack bool
+	draining      bool
 }
 
 func New(c *config.Config, d *docker.Docker) *ClusterService {
@@ -43,10 +54,12 @@ func New(c *config.Config, d *docker.Docker) *ClusterService {
 	}
 }
 
-func (z *ClusterService) Update(master bool, byIndex map[int]db.Member) error {
+func (z *ClusterService) Update(master bool, term int64, byIndex map[int]db.Member) error {
 	newState := clusterState{
 		cluster:        []string{},
+		ports:          []map[string]int{},
 		clusterByIndex: byIndex,
+		size:           z.config.ClusterSize,
 	}
 
 	for i := 1; i <= z.config.ClusterSize; i++ {
@@ -54,9 +67,11 @@ func (z *ClusterService) Update(master bool, byIndex map[int]db.Member) error {
 			newState.index = i
 		}
 		newState.cluster = append(newState.cluster, byIndex[i].IP)
+		newState.ports = append(newState.ports, byIndex[i].Ports)
 	}
 
-	if z.state.index != newState.index || !reflect.DeepEqual(z.state.cluster, newState.cluster) {
+	if z.state.index != newState.index || !reflect.DeepEqual(z.state.cluster, newState.cluster) ||
+		!reflect.DeepEqual(z.state.ports, newState.ports) {
 		if len(newState.cluster) <= z.config.ClusterSize/2 {
 			log.Infof("Waiting for at least %d cluster members", z.config.ClusterSize/2+1)
 			return nil
@@ -67,14 +82,22 @@ func (z *ClusterService) Update(master bool, byIndex map[int]db.Member) error {
 			return err
 		}
 
-		if err := z.launchRancherServer(); err != nil {
-			return err
+		if !z.draining {
+			if err := z.launchRancherServer(); err != nil {
+				return err
+			}
 		}
 
+		z.Lock()
 		z.state = newState
+		z.Unlock()
+	}
+
+	if z.draining {
+		return nil
 	}
 
-	if err := z.launchRancherAgent(master); err != nil {
+	if err := z.launchRancherAgent(master, term); err != nil {
 		log.Infof("Can not launch agent right now: %v", err)
 		// Ensure that the server is running
 		if err := z.launchRancherServer(); err != nil {
@@ -85,7 +108,80 @@ func (z *ClusterService) Update(master bool, byIndex map[int]db.Member) error {
 	return nil
 }
 
-func (z *ClusterService) launchRancherAgent(master bool) error {
+// Size is the cluster size zookeeper and redis were last configured with, 0 before the first Update
+func (z *ClusterService) Size() int {
+	z.Lock()
+	defer z.Unlock()
+
+	return z.state.size
+}
+
+// Reconfigure makes the next Update launch every container again so they pick up a reloaded configuration
+func (z *ClusterService) Reconfigure() {
+	z.Lock()
+	defer z.Unlock()
+
+	z.state.cluster = nil
+	z.launchedStack = false
+}
+
+func (z *ClusterService) Drain(draining bool) error {
+	if draining == z.draining {
+		return nil
+	}
+	z.draining = draining
+
+	if !draining {
+		log.Infof("Member released from draining")
+		return nil
+	}
+
+	log.Infof("Member is draining, stopping server and agent")
+	for _, name := range []string{z.config.ContainerPrefix + "cattle", z.config.ContainerPrefix + "agent", "rancher-agent"} {
+		if err := z.d.Stop(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (z *ClusterService) Status() (Status, error) {
+	z.Lock()
+	state := z.state
+	z.Unlock()
+
+	status := Status{
+		Index:      state.index,
+		Cluster:    state.cluster,
+		Containers: []docker.ContainerStatus{},
+	}
+
+	names := []string{docker.Parent.Name, "cattle"}
+	if state.index > 0 {
+		names = append(names, db.Zk, db.Redis)
+	}
+	for i := 1; i <= state.size; i++ {
+		if _, ok := state.clusterByIndex[i]; !ok {
+			continue
+		}
+		for _, service := range db.ServicePorts {
+			names = append(names, fmt.Sprintf("tunnel-%s-%d", service, i))
+		}
+	}
+
+	for _, name := range names {
+		containerStatus, err := z.d.Status(name)
+		if err != nil {
+			return status, err
+		}
+		status.Containers = append(status.Containers, containerStatus)
+	}
+
+	return status, nil
+}
+
+func (z *ClusterService) launchRancherAgent(master bool, term int64) error {
 	accessKey, secretKey, err := z.config.APIKeys()
 	if err != nil {
 		return errors.New("Waiting for server to create service API key")
@@ -111,6 +207,12 @@ func (z *ClusterService) launchRancherAgent(master bool) error {
 		}
 	}
 
+	if master {
+		if err := z.config.DB.CheckLease(z.config.UUID, term); err != nil {
+			return err
+		}
+	}
+
 	projectURL, token, err := rancher.ConfigureEnvironment(master, z.config.ConfigPath, z.config.CertPath, z.config.KeyPath,
 		z.config.CertChainPath, accessKey, secretKey, url, hostnames...)
 	if err != nil {
@@ -148,6 +250,9 @@ func (z *ClusterService) launchRancherAgent(master bool) error {
 			log.Fatalf("Failed while waiting for %d host(s) to be active: %v", z.config.ClusterSize, err)
 			return err
 		}
+		if err := z.config.DB.CheckLease(z.config.UUID, term); err != nil {
+			return err
+		}
 		env := docker.ToEnv(map[string]string{
 			"CATTLE_HA_PORT_PP_HTTP":  strconv.Itoa(db.LookupPortByService(z.config.Ports, db.PPHTTP)),
 			"CATTLE_HA_PORT_PP_HTTPS": strconv.Itoa(db.LookupPortByService(z.config.Ports, db.PPHTTPS)),
@@ -184,15 +289,17 @@ func (z *ClusterService) launchRancherServer() error {
 		"CATTLE_REDIS_HOSTS":                 z.config.RedisHosts(),
 		"CATTLE_MODULE_PROFILE_ZOOKEEPER":    "true",
 		"CATTLE_ZOOKEEPER_CONNECTION_STRING": z.config.ZkHosts(),
-		"CATTLE_DB_CATTLE_DATABASE":          "mysql",
-		"CATTLE_DB_CATTLE_MYSQL_HOST":        z.config.DBHost,
-		"CATTLE_DB_CATTLE_MYSQL_PORT":        strconv.Itoa(z.config.DBPort),
-		"CATTLE_DB_CATTLE_USERNAME":          z.config.DBUser,
-		"CATTLE_DB_CATTLE_PASSWORD":          z.config.DBPassword,
-		"CATTLE_DB_CATTLE_MYSQL_NAME":        z.config.DBName,
 		"CATTLE_PROXY_PROTOCOL_HTTPS_PORTS":  strconv.Itoa(db.LookupPortByService(z.config.Ports, db.HTTPS)),
 	}
 
+	dbEnv, err := z.config.DBEnv()
+	if err != nil {
+		return err
+	}
+	for k, v := range dbEnv {
+		env[k] = v
+	}
+
 	if z.config.HAEnabled {
 		env["CATTLE_HA_ENABLED"] = "true"
 	}
@@ -218,6 +325,11 @@ func (z *ClusterService) createTunnels(state clusterState) error {
 		}
 	}
 
+	// Indexes dropped by shrinking the cluster
+	for i := state.size + 1; i <= z.state.size; i++ {
+		z.tunnel.DeleteTunnels(i)
+	}
+
 	for i := 1; i <= z.config.ClusterSize; i++ {
 		target, ok := state.clusterByIndex[i]
 		if !ok {
@@ -238,6 +350,14 @@ func (z *ClusterService) configure(state clusterState) error {
 	}
 
 	if state.index <= 0 {
+		if z.state.index > 0 {
+			log.Infof("No longer a member of the quorum, removing %s and %s", db.Zk, db.Redis)
+			for _, service := range []string{db.Zk, db.Redis} {
+				if err := z.d.DeleteIfExists(z.config.ContainerPrefix + service); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
 	}
 
@@ -42,7 +42,7 @@ func (t *TunnelFactory) CreateTunnels(outgoing bool, target db.Member) error {
 		}
 
 		if outgoing {
-			if err := t.pipeEncrypt(service, target.Index, basePort, db.LookupPortByService(t.c.Ports, service), target.IP); err != nil {
+			if err := t.pipeEncrypt(service, target.Index, basePort, db.LookupPortByService(target.Ports, service), target.IP); err != nil {
 				return err
 			}
 		} else {